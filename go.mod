@@ -3,11 +3,16 @@ module github.com/DemmyDemon/boltpile
 go 1.23.0
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
+	github.com/rs/zerolog v1.33.0
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.26.0
+	golang.org/x/time v0.6.0
+)
+
+require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/rs/zerolog v1.33.0 // indirect
-	go.etcd.io/bbolt v1.3.10 // indirect
 	golang.org/x/sys v0.24.0 // indirect
-	golang.org/x/time v0.6.0 // indirect
 )
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog/log"
+)
+
+func DeleteFile(ed storage.EntryDeleter, config storage.Config, limiter *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		entry := r.PathValue("entry")
+		peer := DeterminePeer(config, r)
+
+		if !limiter.Allow(peer) {
+			log.Warn().Str("operation", "delete").Str("pile", pile).Str("entry", entry).Str("peer", peer).Msg("Hit the rate limit!")
+			SendMessage(w, http.StatusTooManyRequests, CHILL_OUT)
+			return
+		}
+
+		pileConfig, err := config.Pile(pile)
+		if err != nil {
+			log.Error().Err(err).Str("operation", "delete").Str("pile", pile).Str("entry", entry).Str("peer", peer).Msg("Couldn't obtain pile config")
+			SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+			return
+		}
+
+		logEntry := log.Info().Str("operation", "delete").Str("pile", pile).Str("entry", entry).Str("peer", peer)
+		if !HasRequiredBearerToken(pileConfig.DELETEKey, r) {
+			logEntry.Msg("Invalid or missing bearer token")
+			SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
+			return
+		}
+
+		w.Header().Add("Access-Control-Allow-Origin", pileConfig.Origin)
+
+		err = ed.DeleteEntry(pile, entry)
+		if err != nil {
+			errLog := log.Error().Err(err).Str("operation", "delete").Str("pile", pile).Str("entry", entry).Str("peer", peer)
+			switch err.(type) {
+			case storage.ErrNoSuchPile:
+				SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+				errLog.Msg("Pile not found")
+			case storage.ErrNoSuchEntry:
+				SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+				errLog.Msg("Entry not found")
+			case storage.ErrEntryHeld:
+				SendFailure(w, http.StatusLocked, "entry is on hold")
+				errLog.Msg("Entry is on hold")
+			case storage.ErrFailedDeletingEntryMetadata:
+				SendMessage(w, http.StatusInternalServerError, OOOPS)
+				errLog.Msg("I love Bolt, but sometimes...")
+			case storage.ErrDuringFileOperation:
+				SendMessage(w, http.StatusInternalServerError, OOOPS)
+				errLog.Msg("File operation failed")
+			default:
+				SendMessage(w, http.StatusInternalServerError, OOOPS)
+				errLog.Msg("Other error")
+			}
+			return
+		}
+
+		SendMessage(w, http.StatusOK, fmt.Sprintf(DELETED, entry))
+		logEntry.Msg("Deleted!")
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func GetFile(eg storage.EntryGetter, config storage.Config) http.HandlerFunc {
+// GetFile also answers POST, which is how the password form comes back.
+func GetFile(eg storage.EntryGetter, config storage.Config, limiter *RateLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		pile := r.PathValue("pile")
 		entry := r.PathValue("entry")
@@ -25,50 +29,133 @@ func GetFile(eg storage.EntryGetter, config storage.Config) http.HandlerFunc {
 		}
 
 		logEntry := log.Info().Str("operation", "read").Str("pile", pile).Str("entry", entry).Str("peer", peer)
-		if !HasBearerToken(pileConfig.GETKey, r) {
-			logEntry.Msg("Invalid or missing bearer token")
-			SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
-			return
-		}
 
 		w.Header().Add("Access-Control-Allow-Origin", pileConfig.Origin)
 
-		err = eg.GetEntry(pile, entry, func(metaData storage.EntryMeta, MIMEType string, file io.Reader) error {
-			now := time.Now()
-			expires := metaData.Time().Add(pileConfig.Lifetime.Duration)
-			if now.After(expires) {
-				return errors.New("entry expired, but was not culled yet")
+		checked, err := eg.GetEntryMeta(pile, entry)
+		if err != nil {
+			sendReadError(w, err, log.Error().Err(err).Str("operation", "read").Str("pile", pile).Str("entry", entry).Str("peer", peer))
+			return
+		}
+		if !mayGetEntry(w, r, pileConfig, checked, limiter, peer, logEntry) {
+			return
+		}
+
+		err = eg.GetEntry(pile, entry, func(metaData storage.EntryMeta, MIMEType string, file io.ReadSeeker) error {
+			if !stillMayGetEntry(w, r, checked, metaData, logEntry) {
+				return nil
+			}
+			encoding := contentEncoding(r, metaData)
+			if encoding != "" {
+				compressed, ok := file.(storage.CompressedContent)
+				if !ok {
+					return errors.New("compressed entry content without the compressed bytes")
+				}
+				var err error
+				if file, err = compressed.Compressed(); err != nil {
+					return err
+				}
+			}
+			size, err := file.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := setEntryHeaders(w, pileConfig, metaData, MIMEType, size, encoding); err != nil {
+				return err
 			}
-			w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
-			w.Header().Set("Last-Modified", metaData.Time().UTC().Format(http.TimeFormat))
-			w.Header().Set("Content-Type", MIMEType)
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=%q", metaData.Filename()))
-			w.WriteHeader(http.StatusOK)
 			logEntry.Msg("Serving data!")
-			_, err = io.Copy(w, file)
-			return err
+			// Takes care of Range, If-Range, If-Modified-Since, If-None-Match and friends.
+			http.ServeContent(w, r, metaData.Filename(), metaData.Time(), file)
+			return nil
 		})
 
 		if err != nil {
-			errLog := log.Error().Err(err).Str("operation", "read").Str("pile", pile).Str("entry", entry).Str("peer", peer)
-			switch err.(type) {
-			case storage.ErrNoSuchPile:
-				SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
-				errLog.Msg("Pile not found")
-			case storage.ErrNoSuchEntry:
-				SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
-				errLog.Msg("Entry not found")
-			case storage.ErrUnparsableMeta:
-				SendMessage(w, http.StatusInternalServerError, OOOPS)
-				errLog.Err(err).Msg("Failed to parse creation time")
-			case storage.ErrDuringFileOperation:
-				SendMessage(w, http.StatusInternalServerError, OOOPS)
-				errLog.Err(err).Msg("File operation failed")
-			default:
-				SendMessage(w, http.StatusInternalServerError, OOOPS)
-				errLog.Err(err).Msg("Other error")
-			}
+			sendReadError(w, err, log.Error().Err(err).Str("operation", "read").Str("pile", pile).Str("entry", entry).Str("peer", peer))
 			return
 		}
 	}
 }
+
+// setEntryHeaders sets everything GET and HEAD have in common, except for
+// Content-Length, which ServeContent has opinions about when serving ranges.
+func setEntryHeaders(w http.ResponseWriter, pileConfig storage.PileConfig, metaData storage.EntryMeta, MIMEType string, size int64, encoding string) error {
+	if metaData.IsExpired(pileConfig.Lifetime.Duration, time.Now()) {
+		return errors.New("entry expired, but was not culled yet")
+	}
+	if expires := metaData.Expires(pileConfig.Lifetime.Duration); !expires.IsZero() {
+		w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Last-Modified", metaData.Time().UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", MIMEType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=%q", metaData.Filename()))
+	w.Header().Set("ETag", entityTag(metaData, size, encoding))
+	if metaData.Codec() != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	return nil
+}
+
+// entityTag is the SHA-256 of the content when we know it. For older entries
+// it has to make do with the size and the time of upload. The compressed bytes
+// are a different representation, so they get a tag of their own.
+func entityTag(metaData storage.EntryMeta, size int64, encoding string) string {
+	if digest := metaData.Digest(); digest != nil {
+		if encoding != "" {
+			return fmt.Sprintf(`"%x-%s"`, digest, encoding)
+		}
+		return fmt.Sprintf(`"%x"`, digest)
+	}
+	return fmt.Sprintf(`"%x-%x"`, size, metaData.Time().Unix())
+}
+
+// contentEncoding is the codec to send the stored bytes with, when the entry is
+// compressed and the client says it can handle that. Otherwise, it's empty and
+// the content gets decompressed on the way out.
+func contentEncoding(r *http.Request, metaData storage.EntryMeta) string {
+	codec := metaData.Codec()
+	if codec == "" {
+		return ""
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(accepted, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), codec) {
+			continue
+		}
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if weight, err := strconv.ParseFloat(q, 64); err != nil || weight == 0 {
+				return ""
+			}
+		}
+		return codec
+	}
+	return ""
+}
+
+func sendReadError(w http.ResponseWriter, err error, errLog *zerolog.Event) {
+	switch err := err.(type) {
+	case storage.ErrNoSuchPile:
+		SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+		errLog.Msg("Pile not found")
+	case storage.ErrNoSuchEntry:
+		SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+		errLog.Msg("Entry not found")
+	case storage.ErrEntryGone:
+		SendMessage(w, http.StatusGone, fmt.Sprintf(ENTRY_GONE, err.Reason, err.Time.UTC().Format(storage.TIME_FORMAT)))
+		errLog.Str("reason", err.Reason).Msg("Entry is gone")
+	case storage.ErrUnparsableMeta:
+		SendMessage(w, http.StatusInternalServerError, OOOPS)
+		errLog.Msg("Failed to parse creation time")
+	case storage.ErrDuringFileOperation:
+		SendMessage(w, http.StatusInternalServerError, OOOPS)
+		errLog.Msg("File operation failed")
+	default:
+		SendMessage(w, http.StatusInternalServerError, OOOPS)
+		errLog.Msg("Other error")
+	}
+}
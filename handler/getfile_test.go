@@ -0,0 +1,82 @@
+package handler_test
+
+import (
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+func TestGetFileRanges(t *testing.T) {
+	server := testServer(t, onePile(storage.PileConfig{}))
+	entry := postEntry(t, server, "0123456789")
+
+	get := func(ranges string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil)
+		r.Header.Set("Range", ranges)
+		return serve(server, r)
+	}
+
+	w := get("bytes=2-4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Errorf("single range got %d %q", w.Code, w.Body)
+	}
+	if contentRange := w.Header().Get("Content-Range"); contentRange != "bytes 2-4/10" {
+		t.Errorf("single range Content-Range is %q", contentRange)
+	}
+
+	w = get("bytes=0-1,8-")
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("multiple ranges got %d %q, %v", w.Code, w.Header().Get("Content-Type"), err)
+	}
+	parts := multipart.NewReader(w.Body, params["boundary"])
+	for _, expected := range []struct{ contentRange, content string }{{"bytes 0-1/10", "01"}, {"bytes 8-9/10", "89"}} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("next part: %s", err)
+		}
+		if contentRange := part.Header.Get("Content-Range"); contentRange != expected.contentRange {
+			t.Errorf("expected part for %s, got %s", expected.contentRange, contentRange)
+		}
+		if content := readBody(t, part); content != expected.content {
+			t.Errorf("part for %s got %q", expected.contentRange, content)
+		}
+	}
+
+	w = get("bytes=20-30")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected 416 for a range past the end, got %d", w.Code)
+	}
+	if contentRange := w.Header().Get("Content-Range"); contentRange != "bytes */10" {
+		t.Errorf("unsatisfiable range Content-Range is %q", contentRange)
+	}
+}
+
+func TestGetFileNotModified(t *testing.T) {
+	server := testServer(t, onePile(storage.PileConfig{}))
+	entry := postEntry(t, server, "same as it ever was")
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("get: %d with ETag %q", w.Code, etag)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil)
+	r.Header.Set("If-None-Match", etag)
+	w = serve(server, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected an empty 304 for a matching ETag, got %d %q", w.Code, w.Body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil)
+	r.Header.Set("If-None-Match", `"something else"`)
+	w = serve(server, r)
+	if w.Code != http.StatusOK || w.Body.String() != "same as it ever was" {
+		t.Errorf("expected the content for a different ETag, got %d %q", w.Code, w.Body)
+	}
+}
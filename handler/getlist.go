@@ -42,7 +42,10 @@ func GetList(eg storage.PileGetter, config storage.Config, limiter *RateLimiter)
 		idents := []string{}
 		now := time.Now()
 		for entryID, entryMeta := range entries {
-			if now.Before(entryMeta.Time().Add(pileConfig.Lifetime.Duration)) {
+			if entryMeta.IsExhausted() {
+				continue
+			}
+			if !entryMeta.IsExpired(pileConfig.Lifetime.Duration, now) {
 				idents = append(idents, entryID)
 			} else {
 				log.Debug().Str("peer", peer).Str("operation", "list").Str("pile", pile).Str("entry", entryID).Str("created", entryMeta.Time().Format(storage.TIME_FORMAT)).Msg("expired, but not culled yet")
@@ -59,13 +62,20 @@ func GetList(eg storage.PileGetter, config storage.Config, limiter *RateLimiter)
 		sb.WriteString(fmt.Sprintf(`"lifetime":%q,`, pileConfig.Lifetime.String()))
 		sb.WriteString(fmt.Sprintf(`"origin":%q,`, pileConfig.Origin))
 		sb.WriteString(`"entries":[`)
-		if len(entries) > 0 {
+		if len(idents) > 0 {
 			sb.WriteRune('\n')
 		}
 		for i, entryID := range idents {
 			entryMeta := entries[entryID]
 			sb.WriteRune('\t')
-			sb.WriteString(fmt.Sprintf(`{"filename":%q,"uploaded":%q,"entry":%q}`, entryMeta.Filename(), entryMeta.Time().UTC().Format(storage.TIME_FORMAT), entryID))
+			sb.WriteString(fmt.Sprintf(`{"filename":%q,"uploaded":%q,"entry":%q`, entryMeta.Filename(), entryMeta.Time().UTC().Format(storage.TIME_FORMAT), entryID))
+			if expires := entryMeta.Expires(pileConfig.Lifetime.Duration); !expires.IsZero() {
+				sb.WriteString(fmt.Sprintf(`,"expires":%q`, expires.UTC().Format(storage.TIME_FORMAT)))
+			}
+			if entryMeta.IsHeld() {
+				sb.WriteString(`,"held":true`)
+			}
+			sb.WriteRune('}')
 			if i < len(idents)-1 {
 				sb.WriteRune(',')
 			}
@@ -15,10 +15,14 @@ const (
 	ACCESS_DENIED    = `{"error":"access denied", "success":false}`
 	NOT_IMPLEMENTED  = `{"error":"not implemented", "success":false}`
 	ENTRY_NOT_FOUND  = `{"error":"entry not found", "success":false}`
+	ENTRY_GONE       = `{"error":"entry gone", "reason":%q, "since":%q, "success":false}`
 	REQUEST_WEIRD    = `{"error":"request too weird", "success":false}`
 	CHILL_OUT        = `{"error":"you need to chill out", "success":false}`
 	OOOPS            = `{"error":"we messed up on our end", "success":false}`
 	SUCCESS          = `{"success":true, "size":%d, "entry":%q}`
+	DELETED          = `{"success":true, "entry":%q}`
+	RESTORED         = `{"success":true, "entry":%q}`
+	HELD             = `{"success":true, "entry":%q, "held":%t}`
 	FAILURE          = `{"error":%q, "success":false}`
 )
 
@@ -66,3 +70,12 @@ func HasBearerToken(token string, r *http.Request) bool {
 	}
 	return candidateToken == token
 }
+
+// HasRequiredBearerToken is HasBearerToken, except an unset token lets nobody in.
+// Operations that destroy data have to be switched on explicitly in the pile config.
+func HasRequiredBearerToken(token string, r *http.Request) bool {
+	if token == "" {
+		return false
+	}
+	return HasBearerToken(token, r)
+}
@@ -0,0 +1,94 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DemmyDemon/boltpile/handler"
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+// testServer routes requests the way main does, to a database of its own over an
+// in-memory blob store. Uploads in progress are kept in the working directory, so
+// that's a temporary one for as long as the test runs.
+func testServer(t *testing.T, config storage.Config) http.Handler {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %s", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("chdir: %s", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	eh, err := storage.OpenBoltDatabase("boltpile.db", config, storage.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("opening database: %s", err)
+	}
+	t.Cleanup(func() { eh.Close() })
+	if err := eh.Startup(config); err != nil {
+		t.Fatalf("startup: %s", err)
+	}
+
+	rateLimiter := handler.NewRateLimiter()
+	mux := http.NewServeMux()
+	mux.Handle("GET /{pile}/{entry}", handler.GetFile(eh, config, rateLimiter))
+	mux.Handle("HEAD /{pile}/{entry}", handler.HeadFile(eh, config, rateLimiter))
+	mux.Handle("PUT /{pile}/{entry}", handler.PutFile(eh, config, rateLimiter))
+	mux.Handle("POST /{pile}/", handler.PostFile(eh, config, rateLimiter))
+	mux.Handle("POST /{pile}/tus/", handler.TusCreate(eh, config, rateLimiter))
+	mux.Handle("HEAD /{pile}/tus/{upload}", handler.TusHead(eh, config))
+	mux.Handle("PATCH /{pile}/tus/{upload}", handler.TusPatch(eh, config))
+	mux.Handle("DELETE /{pile}/tus/{upload}", handler.TusDelete(eh, config))
+	return mux
+}
+
+// onePile is the config of the one pile most tests need.
+func onePile(pileConfig storage.PileConfig) storage.Config {
+	return storage.Config{Piles: map[string]storage.PileConfig{"pile": pileConfig}}
+}
+
+var peers = 0
+
+// serve sends the request from a peer of its own, so none of them hit the rate limit.
+func serve(server http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	peers++
+	r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1995", peers/256, peers%256)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+// postEntry stores the content as the body of a POST, and returns the entry it became.
+func postEntry(t *testing.T, server http.Handler, content string) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/pile/", strings.NewReader(content))
+	r.Header.Set("Content-Type", "text/plain")
+	w := serve(server, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("post: %d %s", w.Code, w.Body)
+	}
+	var result struct {
+		Entry string `json:"entry"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("post response %q: %s", w.Body, err)
+	}
+	return result.Entry
+}
+
+func readBody(t *testing.T, body io.Reader) string {
+	t.Helper()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read body: %s", err)
+	}
+	return string(data)
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog/log"
+)
+
+func HeadFile(es storage.EntryStatter, config storage.Config, limiter *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		entry := r.PathValue("entry")
+		peer := DeterminePeer(config, r)
+
+		pileConfig, err := config.Pile(pile)
+		if err != nil {
+			log.Error().Err(err).Str("operation", "stat").Str("pile", pile).Str("entry", entry).Str("peer", peer).Msg("Couldn't obtain pile config")
+			SendMessage(w, http.StatusInternalServerError, OOOPS)
+			return
+		}
+
+		logEntry := log.Info().Str("operation", "stat").Str("pile", pile).Str("entry", entry).Str("peer", peer)
+
+		w.Header().Add("Access-Control-Allow-Origin", pileConfig.Origin)
+
+		checked, err := es.GetEntryMeta(pile, entry)
+		if err != nil {
+			sendReadError(w, err, log.Error().Err(err).Str("operation", "stat").Str("pile", pile).Str("entry", entry).Str("peer", peer))
+			return
+		}
+		if !mayGetEntry(w, r, pileConfig, checked, limiter, peer, logEntry) {
+			return
+		}
+
+		err = es.StatEntry(pile, entry, func(metaData storage.EntryMeta, MIMEType string, size int64) error {
+			if !stillMayGetEntry(w, r, checked, metaData, logEntry) {
+				return nil
+			}
+			encoding := contentEncoding(r, metaData)
+			if encoding != "" {
+				size = metaData.StoredSize()
+			}
+			if err := setEntryHeaders(w, pileConfig, metaData, MIMEType, size, encoding); err != nil {
+				return err
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.WriteHeader(http.StatusOK)
+			logEntry.Msg("Serving headers!")
+			return nil
+		})
+
+		if err != nil {
+			sendReadError(w, err, log.Error().Err(err).Str("operation", "stat").Str("pile", pile).Str("entry", entry).Str("peer", peer))
+			return
+		}
+	}
+}
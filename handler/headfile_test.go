@@ -0,0 +1,37 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+func TestHeadFile(t *testing.T) {
+	server := testServer(t, onePile(storage.PileConfig{}))
+	entry := postEntry(t, server, "headers only, please")
+
+	got := serve(server, httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil))
+	w := serve(server, httptest.NewRequest(http.MethodHead, "/pile/"+entry, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("head: %d %s", w.Code, w.Body)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected no body for HEAD, got %q", w.Body)
+	}
+	// Everything GET would have said about the entry.
+	for _, header := range []string{"Content-Length", "Content-Type", "Content-Disposition", "ETag", "Last-Modified", "Accept-Ranges"} {
+		if w.Header().Get(header) != got.Header().Get(header) {
+			t.Errorf("HEAD has %s %q, but GET has %q", header, w.Header().Get(header), got.Header().Get(header))
+		}
+	}
+	if length := w.Header().Get("Content-Length"); length != "20" {
+		t.Errorf("expected Content-Length 20, got %q", length)
+	}
+
+	w = serve(server, httptest.NewRequest(http.MethodHead, "/pile/nothing-here", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for HEAD of a missing entry, got %d", w.Code)
+	}
+}
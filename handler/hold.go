@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// HoldFile puts an entry on hold, or releases it, for admins only.
+func HoldFile(eh storage.EntryHolder, config storage.Config, limiter *RateLimiter, hold bool) http.HandlerFunc {
+	operation := "release"
+	if hold {
+		operation = "hold"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		entry := r.PathValue("entry")
+		peer := DeterminePeer(config, r)
+
+		if !limiter.Allow(peer) {
+			log.Warn().Str("operation", operation).Str("pile", pile).Str("entry", entry).Str("peer", peer).Msg("Hit the rate limit!")
+			SendMessage(w, http.StatusTooManyRequests, CHILL_OUT)
+			return
+		}
+		logEntry := log.Info().Str("operation", operation).Str("pile", pile).Str("entry", entry).Str("peer", peer)
+		if !HasRequiredBearerToken(config.AdminKey, r) {
+			logEntry.Msg("Invalid or missing admin token")
+			SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
+			return
+		}
+
+		var err error
+		if hold {
+			err = eh.HoldEntry(pile, entry)
+		} else {
+			err = eh.ReleaseEntry(pile, entry)
+		}
+		if err != nil {
+			errLog := log.Error().Err(err).Str("operation", operation).Str("pile", pile).Str("entry", entry).Str("peer", peer)
+			switch err := err.(type) {
+			case storage.ErrNoSuchPile:
+				SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+				errLog.Msg("Pile not found")
+			case storage.ErrNoSuchEntry:
+				SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+				errLog.Msg("Entry not found")
+			case storage.ErrEntryGone:
+				SendMessage(w, http.StatusGone, fmt.Sprintf(ENTRY_GONE, err.Reason, err.Time.UTC().Format(storage.TIME_FORMAT)))
+				errLog.Str("reason", err.Reason).Msg("Entry is gone")
+			default:
+				SendMessage(w, http.StatusInternalServerError, OOOPS)
+				errLog.Msg("Other error")
+			}
+			return
+		}
+
+		SendMessage(w, http.StatusOK, fmt.Sprintf(HELD, entry, hold))
+		logEntry.Msg("Done!")
+	}
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Entries can have a password of their own, given when uploading. It goes in a
+// header, or in a form field for multipart uploads. Getting the entry back needs
+// the same password, either in the header or posted from PASSWORD_FORM.
+const (
+	PASSWORD_HEADER = "X-Boltpile-Password"
+	PASSWORD_FIELD  = "password"
+	PASSWORD_FORM   = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>Password required</title></head>
+<body>
+<form method="post">
+<p>%s</p>
+<input type="password" name="` + PASSWORD_FIELD + `" autofocus required>
+<button type="submit">Download</button>
+</form>
+</body>
+</html>
+`
+)
+
+func entryPassword(r *http.Request) string {
+	if password := r.Header.Get(PASSWORD_HEADER); password != "" {
+		return password
+	}
+	if r.Method == http.MethodPost {
+		return r.PostFormValue(PASSWORD_FIELD)
+	}
+	return ""
+}
+
+// mayGetEntry decides if the request gets the entry, and if not, tells the client.
+// Entries with a password need it, but then the GET key isn't needed, as that's the
+// whole point. Everything else needs the GET key, as always. Checking a password is
+// deliberately slow, so every check counts against the rate limit, right or wrong,
+// and it's done before the entry is opened, so nothing waits on it and no download
+// is taken for it. The metadata it was decided on is for stillMayGetEntry.
+func mayGetEntry(w http.ResponseWriter, r *http.Request, pileConfig storage.PileConfig, metaData storage.EntryMeta, limiter *RateLimiter, peer string, logEntry *zerolog.Event) bool {
+	if !metaData.HasPassword() {
+		if HasBearerToken(pileConfig.GETKey, r) {
+			return true
+		}
+		logEntry.Msg("Invalid or missing bearer token")
+		SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
+		return false
+	}
+
+	password := entryPassword(r)
+	if password == "" {
+		logEntry.Msg("Password required")
+		sendPasswordRequired(w, r, "This file is password protected.", "password required")
+		return false
+	}
+	if !limiter.Allow(peer) {
+		log.Warn().Str("operation", "read").Str("pile", r.PathValue("pile")).Str("entry", r.PathValue("entry")).Str("peer", peer).Msg("Hit the rate limit!")
+		SendMessage(w, http.StatusTooManyRequests, CHILL_OUT)
+		return false
+	}
+	if !metaData.CheckPassword(password) {
+		logEntry.Msg("Wrong password")
+		sendPasswordRequired(w, r, "Wrong password, try again.", "wrong password")
+		return false
+	}
+	return true
+}
+
+// stillMayGetEntry makes sure the entry that was opened is protected the same way
+// as when mayGetEntry had its say, in case it was replaced in the meantime.
+func stillMayGetEntry(w http.ResponseWriter, r *http.Request, checked storage.EntryMeta, metaData storage.EntryMeta, logEntry *zerolog.Event) bool {
+	if metaData.SamePassword(checked) {
+		return true
+	}
+	logEntry.Msg("Password changed while checking it")
+	sendPasswordRequired(w, r, "This file is password protected.", "password required")
+	return false
+}
+
+// sendPasswordRequired gives browsers a form to type the password into, and everyone else JSON.
+func sendPasswordRequired(w http.ResponseWriter, r *http.Request, message string, problem string) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		SendFailure(w, http.StatusForbidden, problem)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, PASSWORD_FORM, message)
+}
@@ -1,14 +1,25 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// batchResult is how each file of a multi-file upload went.
+type batchResult struct {
+	Success  bool   `json:"success"`
+	Entry    string `json:"entry,omitempty"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Error    string `json:"error,omitempty"`
+}
+
 func PostFile(ec storage.EntryCreator, config storage.Config, limiter *RateLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		pile := r.PathValue("pile")
@@ -36,61 +47,22 @@ func PostFile(ec storage.EntryCreator, config storage.Config, limiter *RateLimit
 
 		w.Header().Add("Access-Control-Allow-Origin", pileConfig.Origin)
 
-		maxSize := pileConfig.MaxSize
-		if maxSize <= 0 {
-			maxSize = MAX_SIZE_DEFAULT
-		}
-
-		r.Body = http.MaxBytesReader(w, r.Body, maxSize+512)
-		err = r.ParseMultipartForm(maxSize)
+		uploads, err := uploadSources(w, r, ec, pile, peer, maxUploadSize(pileConfig))
 		if err != nil {
-			logEntry.Err(err).Msg("Error parsing multipart form.")
-			SendMessage(w, http.StatusBadRequest, REQUEST_WEIRD)
+			logEntry.Err(err).Msg("No usable file in request")
+			sendSourceError(w, err)
 			return
 		}
+		defer closeUploads(uploads)
 
-		size := int64(0)
-
-		file, fileHeader, err := r.FormFile("data")
-		if err != nil {
-			log.Error().Err(err).Str("operation", "write").Str("pile", pile).Str("peer", peer).Msg("NO FORMFILE FOR YOU!!!!")
-			SendMessage(w, http.StatusBadRequest, REQUEST_WEIRD)
+		if len(uploads) > 1 {
+			postBatch(w, ec, pile, peer, uploads)
 			return
 		}
-		entryID, err := ec.CreateEntry(pile, fileHeader.Filename, func(entry string, dst io.Writer) error {
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			size, err = io.Copy(dst, file)
-			return err
-		})
 
+		entryID, size, err := storeUpload(ec, pile, uploads[0])
 		if err != nil {
-			errLog := log.Error().Err(err).Str("operation", "write").Str("pile", pile).Str("entry", entryID).Str("peer", peer)
-			switch err.(type) {
-			case storage.ErrNoSuchPile:
-				errLog.Msg("No such pile")
-				SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
-			case storage.ErrFailedCreatingPileDirectory:
-				errLog.Msg("Could not create directory")
-				SendMessage(w, http.StatusInternalServerError, OOOPS)
-			case storage.ErrFailedMakingId:
-				errLog.Msg("Failed generating UUID, somehow")
-				SendMessage(w, http.StatusInternalServerError, OOOPS)
-			case storage.ErrFailedCreatingEntryFile:
-				errLog.Msg("Well, that didn't work...")
-				SendMessage(w, http.StatusInternalServerError, OOOPS)
-			case storage.ErrDuringFileOperation:
-				errLog.Msg("Looks like weird data from client.")
-				SendMessage(w, http.StatusBadRequest, REQUEST_WEIRD)
-			case storage.ErrFailedStoringEntryMetadata:
-				errLog.Msg("I love Bolt, but sometimes...")
-				SendMessage(w, http.StatusInternalServerError, OOOPS)
-			default:
-				errLog.Msg("Well, that was unexpected...")
-				SendMessage(w, http.StatusInternalServerError, OOOPS)
-			}
+			sendWriteError(w, err, log.Error().Err(err).Str("operation", "write").Str("pile", pile).Str("entry", entryID).Str("peer", peer))
 			return
 		}
 
@@ -98,3 +70,111 @@ func PostFile(ec storage.EntryCreator, config storage.Config, limiter *RateLimit
 		logEntry.Str("entry", entryID).Msg("All done! Stored!")
 	}
 }
+
+func storeUpload(ec storage.EntryCreator, pile string, upload upload) (string, int64, error) {
+	size := int64(0)
+	entryID, err := ec.CreateEntry(pile, upload.info, func(entry string, dst io.Writer) error {
+		var err error
+		size, err = io.Copy(dst, upload.file)
+		return err
+	})
+	return entryID, size, err
+}
+
+// postBatch stores each of the files on its own, so one bad apple doesn't spoil the
+// bunch. If nothing at all could be stored, the status is that of the first failure.
+func postBatch(w http.ResponseWriter, ec storage.EntryCreator, pile string, peer string, uploads []upload) {
+	results := make([]batchResult, 0, len(uploads))
+	stored := 0
+	failStatus := 0
+	for _, upload := range uploads {
+		result := batchResult{Filename: upload.info.Filename}
+		entryID, size, err := storeUpload(ec, pile, upload)
+		if err != nil {
+			status, problem := describeWriteError(err, log.Error().Err(err).Str("operation", "write").Str("pile", pile).Str("filename", upload.info.Filename).Str("peer", peer))
+			if failStatus == 0 {
+				failStatus = status
+			}
+			result.Error = problem
+		} else {
+			result.Success = true
+			result.Entry = entryID
+			result.Size = size
+			stored++
+			log.Info().Str("operation", "write").Str("pile", pile).Str("peer", peer).Str("entry", result.Entry).Msg("All done! Stored!")
+		}
+		results = append(results, result)
+	}
+
+	status := http.StatusOK
+	if stored == 0 {
+		status = failStatus
+	} else if stored < len(uploads) {
+		status = http.StatusMultiStatus
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		log.Error().Err(err).Str("operation", "write").Str("pile", pile).Str("peer", peer).Msg("Could not encode batch results")
+		SendMessage(w, http.StatusInternalServerError, OOOPS)
+		return
+	}
+	SendMessage(w, status, string(body))
+	log.Info().Str("operation", "write").Str("pile", pile).Str("peer", peer).Int("files", len(uploads)).Int("stored", stored).Msg("Batch done!")
+}
+
+func sendWriteError(w http.ResponseWriter, err error, errLog *zerolog.Event) {
+	status, problem := describeWriteError(err, errLog)
+	SendFailure(w, status, problem)
+}
+
+// describeWriteError logs what went wrong while storing an entry, and decides what to tell the client.
+func describeWriteError(err error, errLog *zerolog.Event) (int, string) {
+	if isTooLarge(err) {
+		errLog.Msg("Upload too large")
+		return http.StatusRequestEntityTooLarge, "upload too large"
+	}
+	switch err.(type) {
+	case storage.ErrNoSuchPile:
+		errLog.Msg("No such pile")
+		return http.StatusForbidden, "access denied"
+	case storage.ErrNoSuchEntry:
+		errLog.Msg("No such entry")
+		return http.StatusNotFound, "entry not found"
+	case storage.ErrEntryExists:
+		errLog.Msg("Entry already exists")
+		return http.StatusConflict, "entry already exists"
+	case storage.ErrUnacceptableFilename:
+		errLog.Msg("Filename can not be used as an entry name")
+		return http.StatusBadRequest, "unacceptable filename"
+	case storage.ErrPileFull:
+		errLog.Msg("Pile is full")
+		return http.StatusInsufficientStorage, "pile is full"
+	case storage.ErrEntryHeld:
+		errLog.Msg("Entry is on hold")
+		return http.StatusLocked, "entry is on hold"
+	case storage.ErrDiskFull:
+		errLog.Msg("Disk is above the high watermark")
+		return http.StatusInsufficientStorage, "not enough disk space"
+	case storage.ErrUnacceptableLifetime:
+		errLog.Msg("Lifetime not allowed in this pile")
+		return http.StatusBadRequest, "unacceptable lifetime"
+	case storage.ErrFailedCreatingPileDirectory:
+		errLog.Msg("Could not create directory")
+		return http.StatusInternalServerError, "we messed up on our end"
+	case storage.ErrFailedMakingId:
+		errLog.Msg("Failed generating UUID, somehow")
+		return http.StatusInternalServerError, "we messed up on our end"
+	case storage.ErrFailedCreatingEntryFile:
+		errLog.Msg("Well, that didn't work...")
+		return http.StatusInternalServerError, "we messed up on our end"
+	case storage.ErrDuringFileOperation:
+		errLog.Msg("Looks like weird data from client.")
+		return http.StatusBadRequest, "request too weird"
+	case storage.ErrFailedStoringEntryMetadata:
+		errLog.Msg("I love Bolt, but sometimes...")
+		return http.StatusInternalServerError, "we messed up on our end"
+	default:
+		errLog.Msg("Well, that was unexpected...")
+		return http.StatusInternalServerError, "we messed up on our end"
+	}
+}
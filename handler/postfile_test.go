@@ -0,0 +1,154 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DemmyDemon/boltpile/handler"
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+// formPart is a field of a multipart form, or a file when it has a filename.
+type formPart struct {
+	name     string
+	filename string
+	content  string
+}
+
+func formRequest(t *testing.T, method string, target string, parts ...formPart) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for _, part := range parts {
+		if part.filename == "" {
+			if err := form.WriteField(part.name, part.content); err != nil {
+				t.Fatalf("write form: %s", err)
+			}
+			continue
+		}
+		writer, err := form.CreateFormFile(part.name, part.filename)
+		if err == nil {
+			_, err = writer.Write([]byte(part.content))
+		}
+		if err != nil {
+			t.Fatalf("write form: %s", err)
+		}
+	}
+	if err := form.Close(); err != nil {
+		t.Fatalf("close form: %s", err)
+	}
+	r := httptest.NewRequest(method, target, body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+// spoolsLeft is what multipart uploads left behind. With nowhere to stage blobs,
+// the memory store has them spooled in the default temporary directory.
+func spoolsLeft(t *testing.T, tmp string) []string {
+	t.Helper()
+	spools, err := filepath.Glob(filepath.Join(tmp, storage.TEMP_PREFIX+"*"))
+	if err != nil {
+		t.Fatalf("glob: %s", err)
+	}
+	return spools
+}
+
+func TestPostBatch(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	maxSize := int64(40 << 10)
+	server := testServer(t, onePile(storage.PileConfig{MaxSize: maxSize}))
+
+	// Together well over what one file and the overhead are allowed, as the
+	// allowance grows with each file. The options come after the files.
+	files := []formPart{
+		{"data", "a.txt", strings.Repeat("a", 39<<10)},
+		{"data", "b.txt", strings.Repeat("b", 39<<10)},
+		{"data", "c.txt", strings.Repeat("c", 39<<10)},
+		{"downloads", "", "1"},
+	}
+	w := serve(server, formRequest(t, http.MethodPost, "/pile/", files...))
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+	var results []struct {
+		Success  bool   `json:"success"`
+		Entry    string `json:"entry"`
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("batch response %q: %s", w.Body, err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for i, result := range results {
+		if !result.Success || result.Filename != files[i].filename || result.Size != 39<<10 {
+			t.Errorf("result %d: %+v", i, result)
+		}
+	}
+	if spools := spoolsLeft(t, tmp); len(spools) != 0 {
+		t.Errorf("spooled files left behind: %v", spools)
+	}
+
+	entry := results[0].Entry
+	if w := serve(server, httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil)); w.Code != http.StatusOK {
+		t.Errorf("download: %d %s", w.Code, w.Body)
+	}
+	if w := serve(server, httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil)); w.Code != http.StatusGone {
+		t.Errorf("expected the download limit from after the files to apply, got %d", w.Code)
+	}
+}
+
+func TestPostBatchBudget(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	maxSize := int64(40 << 10)
+	server := testServer(t, onePile(storage.PileConfig{MaxSize: maxSize}))
+
+	tooMany := []formPart{}
+	for range handler.MAX_BATCH_FILES + 1 {
+		tooMany = append(tooMany, formPart{"data", "a.txt", "a"})
+	}
+	tests := []struct {
+		name   string
+		parts  []formPart
+		status int
+	}{
+		{"file too large", []formPart{{"data", "big.bin", strings.Repeat("x", 41<<10)}}, http.StatusRequestEntityTooLarge},
+		{"field too large", []formPart{{"data", "a.txt", "a"}, {"downloads", "", strings.Repeat("1", handler.MULTIPART_OVERHEAD+1)}}, http.StatusRequestEntityTooLarge},
+		// Files that aren't data don't get an allowance of their own.
+		{"not data", []formPart{{"data", "a.txt", "a"}, {"junk", "junk.bin", strings.Repeat("j", 110<<10)}}, http.StatusRequestEntityTooLarge},
+		{"no data", []formPart{{"junk", "junk.bin", "j"}}, http.StatusBadRequest},
+		{"too many files", tooMany, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		if w := serve(server, formRequest(t, http.MethodPost, "/pile/", test.parts...)); w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.status, w.Code, w.Body)
+		}
+		if spools := spoolsLeft(t, tmp); len(spools) != 0 {
+			t.Errorf("%s: spooled files left behind: %v", test.name, spools)
+		}
+	}
+}
+
+func TestPutOneFileAtATime(t *testing.T) {
+	server := testServer(t, onePile(storage.PileConfig{PUTKey: "sesame"}))
+	entry := postEntry(t, server, "original")
+	r := formRequest(t, http.MethodPut, "/pile/"+entry, formPart{"data", "a.txt", "a"}, formPart{"data", "b.txt", "b"})
+	r.Header.Set("Authorization", "Bearer sesame")
+	if w := serve(server, r); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 replacing with two files, got %d %s", w.Code, w.Body)
+	}
+	if w := serve(server, httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil)); w.Body.String() != "original" {
+		t.Errorf("entry got replaced anyway, with %q", w.Body)
+	}
+}
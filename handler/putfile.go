@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog/log"
+)
+
+func PutFile(er storage.EntryReplacer, config storage.Config, limiter *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		entry := r.PathValue("entry")
+		peer := DeterminePeer(config, r)
+
+		if !limiter.Allow(peer) {
+			log.Warn().Str("operation", "replace").Str("pile", pile).Str("entry", entry).Str("peer", peer).Msg("Hit the rate limit!")
+			SendMessage(w, http.StatusTooManyRequests, CHILL_OUT)
+			return
+		}
+
+		logEntry := log.Info().Str("operation", "replace").Str("pile", pile).Str("entry", entry).Str("peer", peer)
+
+		pileConfig, err := config.Pile(pile)
+		if err != nil {
+			log.Error().Err(err).Str("operation", "replace").Str("pile", pile).Str("entry", entry).Str("peer", peer).Msg("Couldn't obtain pile config")
+			SendMessage(w, http.StatusInternalServerError, OOOPS)
+			return
+		}
+		if !HasRequiredBearerToken(pileConfig.PUTKey, r) {
+			logEntry.Msg("Invalid or missing bearer token")
+			SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
+			return
+		}
+
+		w.Header().Add("Access-Control-Allow-Origin", pileConfig.Origin)
+
+		uploads, err := uploadSources(w, r, er, pile, peer, maxUploadSize(pileConfig))
+		if err != nil {
+			logEntry.Err(err).Msg("No usable file in request")
+			sendSourceError(w, err)
+			return
+		}
+		defer closeUploads(uploads)
+		if len(uploads) > 1 {
+			logEntry.Int("files", len(uploads)).Msg("Can only replace with one file")
+			SendFailure(w, http.StatusBadRequest, "one file at a time")
+			return
+		}
+
+		size := int64(0)
+		err = er.ReplaceEntry(pile, entry, uploads[0].info, func(entry string, dst io.Writer) error {
+			size, err = io.Copy(dst, uploads[0].file)
+			return err
+		})
+		if err != nil {
+			sendWriteError(w, err, log.Error().Err(err).Str("operation", "replace").Str("pile", pile).Str("entry", entry).Str("peer", peer))
+			return
+		}
+
+		SendMessage(w, http.StatusOK, fmt.Sprintf(SUCCESS, size, entry))
+		logEntry.Msg("All done! Replaced!")
+	}
+}
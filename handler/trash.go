@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// The trash is for admins only, whatever the keys of the pile say.
+
+func GetTrash(th storage.TrashHandler, config storage.Config, limiter *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		peer := DeterminePeer(config, r)
+
+		if !limiter.Allow(peer) {
+			log.Warn().Str("operation", "trash").Str("pile", pile).Str("peer", peer).Msg("Hit the rate limit!")
+			SendMessage(w, http.StatusTooManyRequests, CHILL_OUT)
+			return
+		}
+		if !HasRequiredBearerToken(config.AdminKey, r) {
+			log.Warn().Str("operation", "trash").Str("pile", pile).Str("peer", peer).Msg("Invalid or missing admin token")
+			SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
+			return
+		}
+		pileConfig, err := config.Pile(pile)
+		if err != nil {
+			log.Error().Err(err).Str("operation", "trash").Str("pile", pile).Str("peer", peer).Msg("Couldn't obtain pile config")
+			SendFailure(w, http.StatusNotFound, "pile not found")
+			return
+		}
+
+		entries, err := th.GetTrash(pile)
+		if err != nil {
+			log.Error().Err(err).Str("operation", "trash").Str("pile", pile).Str("peer", peer).Msg("Failed obtaining trash")
+			SendMessage(w, http.StatusInternalServerError, OOOPS)
+			return
+		}
+		idents := make([]string, 0, len(entries))
+		for entryID := range entries {
+			idents = append(idents, entryID)
+		}
+		sort.SliceStable(idents, func(a int, b int) bool {
+			return entries[idents[a]].Time.Before(entries[idents[b]].Time)
+		})
+
+		sb := strings.Builder{}
+		sb.WriteRune('{')
+		sb.WriteString(`"format":1,`)
+		sb.WriteString(fmt.Sprintf(`"grace":%q,`, pileConfig.TrashGrace.String()))
+		sb.WriteString(`"entries":[`)
+		if len(idents) > 0 {
+			sb.WriteRune('\n')
+		}
+		for i, entryID := range idents {
+			trashed := entries[entryID]
+			sb.WriteRune('\t')
+			sb.WriteString(fmt.Sprintf(`{"filename":%q,"uploaded":%q,"entry":%q,"reason":%q,"trashed":%q,"purges":%q}`,
+				trashed.Meta.Filename(),
+				trashed.Meta.Time().UTC().Format(storage.TIME_FORMAT),
+				entryID,
+				trashed.Reason,
+				trashed.Time.UTC().Format(storage.TIME_FORMAT),
+				trashed.Purges(pileConfig.TrashGrace.Duration).UTC().Format(storage.TIME_FORMAT),
+			))
+			if i < len(idents)-1 {
+				sb.WriteRune(',')
+			}
+			sb.WriteRune('\n')
+		}
+		sb.WriteString(`]}`)
+		SendMessage(w, http.StatusOK, sb.String())
+		log.Info().Str("operation", "trash").Str("pile", pile).Str("peer", peer).Int("entries", len(idents)).Msg("Served!")
+	}
+}
+
+func RestoreFile(th storage.TrashHandler, config storage.Config, limiter *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		entry := r.PathValue("entry")
+		peer := DeterminePeer(config, r)
+
+		if !limiter.Allow(peer) {
+			log.Warn().Str("operation", "restore").Str("pile", pile).Str("entry", entry).Str("peer", peer).Msg("Hit the rate limit!")
+			SendMessage(w, http.StatusTooManyRequests, CHILL_OUT)
+			return
+		}
+		logEntry := log.Info().Str("operation", "restore").Str("pile", pile).Str("entry", entry).Str("peer", peer)
+		if !HasRequiredBearerToken(config.AdminKey, r) {
+			logEntry.Msg("Invalid or missing admin token")
+			SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
+			return
+		}
+
+		err := th.RestoreEntry(pile, entry)
+		if err != nil {
+			errLog := log.Error().Err(err).Str("operation", "restore").Str("pile", pile).Str("entry", entry).Str("peer", peer)
+			switch err.(type) {
+			case storage.ErrNoSuchPile:
+				SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+				errLog.Msg("Pile not found")
+			case storage.ErrNotInTrash:
+				SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+				errLog.Msg("Entry not in the trash")
+			case storage.ErrEntryExists:
+				SendFailure(w, http.StatusConflict, "entry already exists")
+				errLog.Msg("Something else is there now")
+			default:
+				SendMessage(w, http.StatusInternalServerError, OOOPS)
+				errLog.Msg("Other error")
+			}
+			return
+		}
+
+		SendMessage(w, http.StatusOK, fmt.Sprintf(RESTORED, entry))
+		logEntry.Msg("Restored!")
+	}
+}
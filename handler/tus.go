@@ -0,0 +1,279 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// The core protocol of https://tus.io/protocols/resumable-upload, plus the creation
+// and termination extensions. Uploads live under /{pile}/tus/ and need the POST key.
+const (
+	TUS_VERSION     = "1.0.0"
+	TUS_EXTENSIONS  = "creation,termination"
+	TUS_CONTENTTYPE = "application/offset+octet-stream"
+	ENTRY_HEADER    = "X-Boltpile-Entry"
+)
+
+var tusExposedHeaders = strings.Join([]string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", ENTRY_HEADER}, ", ")
+
+// tusPreamble does what every tus request has in common, and reports if the request may go on.
+func tusPreamble(w http.ResponseWriter, r *http.Request, config storage.Config, logEntry *zerolog.Event) (storage.PileConfig, bool) {
+	w.Header().Set("Tus-Resumable", TUS_VERSION)
+
+	pileConfig, err := config.Pile(r.PathValue("pile"))
+	if err != nil {
+		logEntry.Err(err).Msg("Couldn't obtain pile config")
+		SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+		return pileConfig, false
+	}
+	w.Header().Add("Access-Control-Allow-Origin", pileConfig.Origin)
+	w.Header().Set("Access-Control-Expose-Headers", tusExposedHeaders)
+
+	if r.Header.Get("Tus-Resumable") != TUS_VERSION {
+		logEntry.Str("version", r.Header.Get("Tus-Resumable")).Msg("Unsupported tus version")
+		w.Header().Set("Tus-Version", TUS_VERSION)
+		SendFailure(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return pileConfig, false
+	}
+	if !HasBearerToken(pileConfig.POSTKey, r) {
+		logEntry.Msg("Invalid or missing bearer token")
+		SendMessage(w, http.StatusForbidden, ACCESS_DENIED)
+		return pileConfig, false
+	}
+	return pileConfig, true
+}
+
+// parseUploadMetadata picks apart "key base64value,key base64value", as per the tus spec.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return metadata, fmt.Errorf("upload metadata %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// tusOption is like uploadOption, except the fallback for the header is the upload metadata.
+func tusOption(r *http.Request, metadata map[string]string, header string, key string) string {
+	if value := r.Header.Get(header); value != "" {
+		return value
+	}
+	return metadata[key]
+}
+
+func setUploadHeaders(w http.ResponseWriter, upload storage.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if upload.IsComplete() {
+		w.Header().Set(ENTRY_HEADER, upload.Entry)
+	}
+}
+
+func TusOptions(config storage.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pileConfig, err := config.Pile(r.PathValue("pile"))
+		if err != nil {
+			SendMessage(w, http.StatusNotFound, ENTRY_NOT_FOUND)
+			return
+		}
+		w.Header().Set("Tus-Resumable", TUS_VERSION)
+		w.Header().Set("Tus-Version", TUS_VERSION)
+		w.Header().Set("Tus-Extension", TUS_EXTENSIONS)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize(pileConfig), 10))
+		w.Header().Add("Access-Control-Allow-Origin", pileConfig.Origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", tusExposedHeaders)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TusCreate(uh storage.UploadHandler, config storage.Config, limiter *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		peer := DeterminePeer(config, r)
+
+		if !limiter.Allow(peer) {
+			log.Warn().Str("operation", "upload").Str("pile", pile).Str("peer", peer).Msg("Hit the rate limit!")
+			SendMessage(w, http.StatusTooManyRequests, CHILL_OUT)
+			return
+		}
+
+		logEntry := log.Info().Str("operation", "upload").Str("pile", pile).Str("peer", peer)
+		pileConfig, ok := tusPreamble(w, r, config, logEntry)
+		if !ok {
+			return
+		}
+
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			log.Warn().Str("operation", "upload").Str("pile", pile).Str("peer", peer).Str("length", r.Header.Get("Upload-Length")).Msg("Missing or invalid Upload-Length")
+			SendMessage(w, http.StatusBadRequest, REQUEST_WEIRD)
+			return
+		}
+		if length > maxUploadSize(pileConfig) {
+			log.Warn().Str("operation", "upload").Str("pile", pile).Str("peer", peer).Int64("length", length).Msg("Upload too large")
+			SendFailure(w, http.StatusRequestEntityTooLarge, "upload too large")
+			return
+		}
+		metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			log.Warn().Err(err).Str("operation", "upload").Str("pile", pile).Str("peer", peer).Msg("Unparsable Upload-Metadata")
+			SendMessage(w, http.StatusBadRequest, REQUEST_WEIRD)
+			return
+		}
+		filename := metadata["filename"]
+		if filename == "" {
+			filename = metadata["name"]
+		}
+		if filename == "" {
+			filename = "data"
+		}
+		downloads, err := downloadLimit(tusOption(r, metadata, DOWNLOADS_HEADER, DOWNLOADS_FIELD))
+		if err != nil {
+			logEntry.Err(err).Msg("Unusable upload options")
+			sendSourceError(w, err)
+			return
+		}
+		lifetime, err := entryLifetime(tusOption(r, metadata, LIFETIME_HEADER, LIFETIME_FIELD))
+		if err != nil {
+			logEntry.Err(err).Msg("Unusable upload options")
+			sendSourceError(w, err)
+			return
+		}
+		info := storage.UploadInfo{
+			Filename:  filename,
+			Peer:      peer,
+			Password:  tusOption(r, metadata, PASSWORD_HEADER, PASSWORD_FIELD),
+			Downloads: downloads,
+			Lifetime:  lifetime,
+		}
+
+		upload, err := uh.CreateUpload(pile, info, length)
+		if err != nil {
+			sendUploadError(w, err, log.Error().Err(err).Str("operation", "upload").Str("pile", pile).Str("upload", upload.ID).Str("peer", peer))
+			return
+		}
+
+		setUploadHeaders(w, upload)
+		w.Header().Set("Location", fmt.Sprintf("/%s/tus/%s", pile, upload.ID))
+		w.WriteHeader(http.StatusCreated)
+		logEntry.Str("upload", upload.ID).Int64("length", length).Msg("Upload created!")
+	}
+}
+
+func TusHead(uh storage.UploadHandler, config storage.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		id := r.PathValue("upload")
+		peer := DeterminePeer(config, r)
+
+		logEntry := log.Debug().Str("operation", "upload").Str("pile", pile).Str("upload", id).Str("peer", peer)
+		if _, ok := tusPreamble(w, r, config, logEntry); !ok {
+			return
+		}
+
+		upload, err := uh.GetUpload(pile, id)
+		if err != nil {
+			sendUploadError(w, err, log.Error().Err(err).Str("operation", "upload").Str("pile", pile).Str("upload", id).Str("peer", peer))
+			return
+		}
+		setUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusOK)
+		logEntry.Int64("offset", upload.Offset).Msg("Upload offset requested")
+	}
+}
+
+func TusPatch(uh storage.UploadHandler, config storage.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		id := r.PathValue("upload")
+		peer := DeterminePeer(config, r)
+
+		logEntry := log.Info().Str("operation", "upload").Str("pile", pile).Str("upload", id).Str("peer", peer)
+		pileConfig, ok := tusPreamble(w, r, config, logEntry)
+		if !ok {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != TUS_CONTENTTYPE {
+			SendFailure(w, http.StatusUnsupportedMediaType, "expected "+TUS_CONTENTTYPE)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			log.Warn().Str("operation", "upload").Str("pile", pile).Str("upload", id).Str("peer", peer).Str("offset", r.Header.Get("Upload-Offset")).Msg("Missing or invalid Upload-Offset")
+			SendMessage(w, http.StatusBadRequest, REQUEST_WEIRD)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize(pileConfig)+1)
+		upload, err := uh.WriteUpload(pile, id, offset, r.Body)
+		if err != nil {
+			sendUploadError(w, err, log.Error().Err(err).Str("operation", "upload").Str("pile", pile).Str("upload", id).Str("peer", peer))
+			return
+		}
+
+		setUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+		if upload.IsComplete() {
+			logEntry.Str("entry", upload.Entry).Msg("All done! Stored!")
+		} else {
+			logEntry.Int64("offset", upload.Offset).Int64("length", upload.Length).Msg("Upload progressed")
+		}
+	}
+}
+
+func TusDelete(uh storage.UploadHandler, config storage.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pile := r.PathValue("pile")
+		id := r.PathValue("upload")
+		peer := DeterminePeer(config, r)
+
+		logEntry := log.Info().Str("operation", "upload").Str("pile", pile).Str("upload", id).Str("peer", peer)
+		if _, ok := tusPreamble(w, r, config, logEntry); !ok {
+			return
+		}
+
+		if err := uh.DeleteUpload(pile, id); err != nil {
+			sendUploadError(w, err, log.Error().Err(err).Str("operation", "upload").Str("pile", pile).Str("upload", id).Str("peer", peer))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		logEntry.Msg("Upload terminated")
+	}
+}
+
+func sendUploadError(w http.ResponseWriter, err error, errLog *zerolog.Event) {
+	switch err.(type) {
+	case storage.ErrNoSuchUpload:
+		errLog.Msg("No such upload")
+		SendFailure(w, http.StatusNotFound, "upload not found")
+	case storage.ErrUploadOffsetMismatch:
+		errLog.Msg("Upload offset mismatch")
+		SendFailure(w, http.StatusConflict, "upload offset mismatch")
+	case storage.ErrUploadLocked:
+		errLog.Msg("Upload is busy")
+		SendFailure(w, http.StatusLocked, "upload is busy")
+	case storage.ErrUploadTooLong:
+		errLog.Msg("Got more than Upload-Length")
+		SendFailure(w, http.StatusRequestEntityTooLarge, "more data than declared")
+	default:
+		sendWriteError(w, err, errLog)
+	}
+}
@@ -0,0 +1,104 @@
+package handler_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DemmyDemon/boltpile/handler"
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+// tusRequest is a request to the resumable uploads, in the version they speak.
+func tusRequest(method string, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	r.Header.Set("Tus-Resumable", handler.TUS_VERSION)
+	return r
+}
+
+// createUpload starts a resumable upload, and returns where it's at.
+func createUpload(t *testing.T, server http.Handler, length int) string {
+	t.Helper()
+	r := tusRequest(http.MethodPost, "/pile/tus/", nil)
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	w := serve(server, r)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || location == "" {
+		t.Fatalf("create upload: %d at %q %s", w.Code, location, w.Body)
+	}
+	return location
+}
+
+func patchUpload(server http.Handler, location string, offset int, content string) *httptest.ResponseRecorder {
+	r := tusRequest(http.MethodPatch, location, strings.NewReader(content))
+	r.Header.Set("Content-Type", handler.TUS_CONTENTTYPE)
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return serve(server, r)
+}
+
+func TestTusUpload(t *testing.T) {
+	server := testServer(t, onePile(storage.PileConfig{}))
+	location := createUpload(t, server, 10)
+
+	w := patchUpload(server, location, 0, "01234")
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first patch: %d at offset %q %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+	// Sent again, as if the client never heard back, and then from too far ahead.
+	for _, offset := range []int{0, 7} {
+		if w := patchUpload(server, location, offset, "56789"); w.Code != http.StatusConflict {
+			t.Errorf("expected 409 patching at offset %d, got %d", offset, w.Code)
+		}
+	}
+
+	w = serve(server, tusRequest(http.MethodHead, location, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "10" {
+		t.Errorf("head: %d at offset %q of %q", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expected the upload offset not to be cached, got Cache-Control %q", w.Header().Get("Cache-Control"))
+	}
+
+	w = patchUpload(server, location, 5, "56789")
+	entry := w.Header().Get(handler.ENTRY_HEADER)
+	if w.Code != http.StatusNoContent || entry == "" {
+		t.Fatalf("last patch: %d for entry %q %s", w.Code, entry, w.Body)
+	}
+	if w := serve(server, httptest.NewRequest(http.MethodGet, "/pile/"+entry, nil)); w.Body.String() != "0123456789" {
+		t.Errorf("finished upload got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestTusDelete(t *testing.T) {
+	server := testServer(t, onePile(storage.PileConfig{}))
+	location := createUpload(t, server, 10)
+	if w := patchUpload(server, location, 0, "01234"); w.Code != http.StatusNoContent {
+		t.Fatalf("patch: %d %s", w.Code, w.Body)
+	}
+
+	if w := serve(server, tusRequest(http.MethodDelete, location, nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := serve(server, tusRequest(http.MethodHead, location, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for HEAD of a terminated upload, got %d", w.Code)
+	}
+	if w := patchUpload(server, location, 5, "56789"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for PATCH of a terminated upload, got %d", w.Code)
+	}
+	if w := serve(server, tusRequest(http.MethodDelete, location, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for DELETE of a terminated upload, got %d", w.Code)
+	}
+}
+
+func TestTusVersion(t *testing.T) {
+	server := testServer(t, onePile(storage.PileConfig{}))
+	r := httptest.NewRequest(http.MethodPost, "/pile/tus/", nil)
+	r.Header.Set("Upload-Length", "10")
+	w := serve(server, r)
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("Tus-Version") != handler.TUS_VERSION {
+		t.Errorf("expected 412 with the supported version, got %d with %q", w.Code, w.Header().Get("Tus-Version"))
+	}
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+const (
+	FILENAME_HEADER  = "X-Boltpile-Filename"
+	FILENAME_PARAM   = "filename"
+	DOWNLOADS_HEADER = "X-Boltpile-Downloads"
+	DOWNLOADS_FIELD  = "downloads"
+	LIFETIME_HEADER  = "X-Boltpile-Lifetime"
+	LIFETIME_FIELD   = "lifetime"
+	MAX_BATCH_FILES  = 20
+	// MULTIPART_OVERHEAD is how much a multipart upload can be larger than its files,
+	// for the boundaries, the part headers and the other fields.
+	MULTIPART_OVERHEAD = 64 << 10
+)
+
+var errTooManyFiles = errors.New("too many files in one request")
+var errBadDownloads = errors.New("downloads must be a positive number")
+var errBadLifetime = errors.New("lifetime must be a duration, like 36h")
+
+// upload is one file that came with a request, ready to be copied into storage.
+type upload struct {
+	info storage.UploadInfo
+	file io.ReadCloser
+}
+
+func maxUploadSize(pileConfig storage.PileConfig) int64 {
+	if pileConfig.MaxSize <= 0 {
+		return MAX_SIZE_DEFAULT
+	}
+	return pileConfig.MaxSize
+}
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// uploadOption is set with a header, or for multipart uploads, a form field.
+// The header wins if both are there.
+func uploadOption(r *http.Request, header string, field string) string {
+	value := r.Header.Get(header)
+	if value == "" && r.MultipartForm != nil {
+		if values := r.MultipartForm.Value[field]; len(values) > 0 {
+			value = values[0]
+		}
+	}
+	return value
+}
+
+// downloadLimit is how many times the upload can be downloaded, with zero for no limit.
+func downloadLimit(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	downloads, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || downloads == 0 {
+		return 0, errBadDownloads
+	}
+	return downloads, nil
+}
+
+// entryLifetime is what the upload asks for instead of the pile lifetime, if anything.
+// Whether that's allowed is up to the pile config.
+func entryLifetime(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime <= 0 {
+		return 0, errBadLifetime
+	}
+	return lifetime, nil
+}
+
+func isTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// uploadSources finds the files in the request. That's either the "data" parts of a
+// multipart form, or the request body itself, which then goes straight to storage
+// without being spooled anywhere first. The caller has to close them all.
+func uploadSources(w http.ResponseWriter, r *http.Request, spooler storage.EntrySpooler, pile string, peer string, maxSize int64) ([]upload, error) {
+	if !isMultipart(r) {
+		if r.ContentLength > maxSize {
+			return nil, &http.MaxBytesError{Limit: maxSize}
+		}
+		downloads, err := downloadLimit(uploadOption(r, DOWNLOADS_HEADER, DOWNLOADS_FIELD))
+		if err != nil {
+			return nil, err
+		}
+		lifetime, err := entryLifetime(uploadOption(r, LIFETIME_HEADER, LIFETIME_FIELD))
+		if err != nil {
+			return nil, err
+		}
+		info := storage.UploadInfo{
+			Filename:  r.Header.Get(FILENAME_HEADER),
+			Peer:      peer,
+			Password:  r.Header.Get(PASSWORD_HEADER),
+			Downloads: downloads,
+			Lifetime:  lifetime,
+			Length:    max(r.ContentLength, 0),
+		}
+		if info.Filename == "" {
+			info.Filename = r.URL.Query().Get(FILENAME_PARAM)
+		}
+		if info.Filename == "" {
+			info.Filename = "data"
+		}
+		// What curl sends by default for --data-binary says nothing about the content.
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/x-www-form-urlencoded" {
+			info.ContentType = contentType
+		}
+		return []upload{{info: info, file: http.MaxBytesReader(w, r.Body, maxSize)}}, nil
+	}
+
+	return multipartSources(r, spooler, pile, peer, maxSize)
+}
+
+// multipartSources reads the form one part at a time, so it can give up on the whole
+// request as soon as any one file turns out to be too large. The files are spooled,
+// as the fields that go with them might come after them.
+func multipartSources(r *http.Request, spooler storage.EntrySpooler, pile string, peer string, maxSize int64) (uploads []upload, err error) {
+	budget := &bodyBudget{body: r.Body, limit: MULTIPART_OVERHEAD + maxSize}
+	r.Body = budget
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			closeUploads(uploads)
+			uploads = nil
+		}
+	}()
+	form := &multipart.Form{Value: map[string][]string{}}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploads, err
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, MULTIPART_OVERHEAD+1))
+			if err != nil {
+				return uploads, err
+			}
+			if len(value) > MULTIPART_OVERHEAD {
+				return uploads, &http.MaxBytesError{Limit: MULTIPART_OVERHEAD}
+			}
+			form.Value[part.FormName()] = append(form.Value[part.FormName()], string(value))
+			continue
+		}
+		if part.FormName() != "data" {
+			continue
+		}
+		if len(uploads) == MAX_BATCH_FILES {
+			return uploads, errTooManyFiles
+		}
+		if len(uploads) > 0 {
+			budget.limit += maxSize
+		}
+		file, size, err := spoolPart(spooler, pile, part, maxSize)
+		if err != nil {
+			return uploads, err
+		}
+		uploads = append(uploads, upload{info: storage.UploadInfo{Filename: part.FileName(), Peer: peer, Length: size}, file: file})
+	}
+	if len(uploads) == 0 {
+		return uploads, http.ErrMissingFile
+	}
+
+	r.MultipartForm = form
+	downloads, err := downloadLimit(uploadOption(r, DOWNLOADS_HEADER, DOWNLOADS_FIELD))
+	if err != nil {
+		return uploads, err
+	}
+	lifetime, err := entryLifetime(uploadOption(r, LIFETIME_HEADER, LIFETIME_FIELD))
+	if err != nil {
+		return uploads, err
+	}
+	password := uploadOption(r, PASSWORD_HEADER, PASSWORD_FIELD)
+	for i := range uploads {
+		uploads[i].info.Password = password
+		uploads[i].info.Downloads = downloads
+		uploads[i].info.Lifetime = lifetime
+	}
+	return uploads, nil
+}
+
+// spoolPart copies a file from a multipart form to where the pile spools uploads, which
+// is removed again when closed. It stops reading as soon as the file is larger than maxSize.
+func spoolPart(spooler storage.EntrySpooler, pile string, part *multipart.Part, maxSize int64) (io.ReadCloser, int64, error) {
+	spooled, err := spooler.SpoolEntry(pile)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(spooled, io.LimitReader(part, maxSize+1))
+	if err == nil && size > maxSize {
+		err = &http.MaxBytesError{Limit: maxSize}
+	}
+	if err == nil {
+		_, err = spooled.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, 0, err
+	}
+	return spooled, size, nil
+}
+
+// bodyBudget is like http.MaxBytesReader, except the limit can be raised while reading,
+// for when a multipart upload turns out to be a batch.
+type bodyBudget struct {
+	body  io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *bodyBudget) Read(p []byte) (int, error) {
+	if b.read >= b.limit {
+		return 0, &http.MaxBytesError{Limit: b.limit}
+	}
+	if left := b.limit - b.read; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := b.body.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func (b *bodyBudget) Close() error {
+	return b.body.Close()
+}
+
+func closeUploads(uploads []upload) {
+	for _, upload := range uploads {
+		if upload.file != nil {
+			upload.file.Close()
+		}
+	}
+}
+
+// sendSourceError explains why uploadSources didn't find anything to store.
+func sendSourceError(w http.ResponseWriter, err error) {
+	switch {
+	case isTooLarge(err):
+		SendFailure(w, http.StatusRequestEntityTooLarge, "upload too large")
+	case errors.Is(err, errTooManyFiles):
+		SendFailure(w, http.StatusBadRequest, errTooManyFiles.Error())
+	case errors.Is(err, errBadDownloads), errors.Is(err, errBadLifetime):
+		SendFailure(w, http.StatusBadRequest, err.Error())
+	case errors.As(err, &storage.ErrDiskFull{}):
+		SendFailure(w, http.StatusInsufficientStorage, "not enough disk space")
+	case errors.As(err, &storage.ErrFailedCreatingEntryFile{}):
+		SendFailure(w, http.StatusInternalServerError, "we messed up on our end")
+	default:
+		SendMessage(w, http.StatusBadRequest, REQUEST_WEIRD)
+	}
+}
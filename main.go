@@ -69,6 +69,21 @@ func setupPort() string {
 	return port
 }
 
+// rotateKeys re-encrypts everything in the encrypted piles with their current key,
+// so the old ones can be retired. It's meant to be run while boltpile itself isn't.
+func rotateKeys(config storage.Config, entryHandler storage.BoltDatabase) {
+	for pile, pileConfig := range config.Piles {
+		if !pileConfig.IsEncrypted() {
+			continue
+		}
+		rotated, err := entryHandler.RotateKeys(pile)
+		if err != nil {
+			log.Fatal().Err(err).Str("pile", pile).Int("rotated", rotated).Msg("Key rotation failed")
+		}
+		log.Info().Str("pile", pile).Int("rotated", rotated).Msg("Keys rotated")
+	}
+}
+
 func main() {
 	setupLogging()
 	dir := setupDirectory()
@@ -77,10 +92,15 @@ func main() {
 
 	log.Info().Msgf("boltpile starting in %s, listening on %s:%s", dir, bind, port)
 
-	entryHandler := storage.MustOpenBoltDatabase("boltpile.db")
-
 	config := storage.LoadConfig("boltpile.json")
 
+	entryHandler := storage.MustOpenBoltDatabase("boltpile.db", config)
+
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		rotateKeys(config, entryHandler)
+		return
+	}
+
 	if err := entryHandler.Startup(config); err != nil {
 		log.Fatal().Err(err).Msg("Error during startup maintenance")
 	}
@@ -88,9 +108,22 @@ func main() {
 
 	rateLimiter := handler.NewRateLimiter()
 
-	http.Handle("GET /{pile}/{entry}", handler.GetFile(entryHandler, config))
+	http.Handle("GET /{pile}/{entry}", handler.GetFile(entryHandler, config, rateLimiter))
+	http.Handle("POST /{pile}/{entry}", handler.GetFile(entryHandler, config, rateLimiter))
+	http.Handle("HEAD /{pile}/{entry}", handler.HeadFile(entryHandler, config, rateLimiter))
+	http.Handle("PUT /{pile}/{entry}", handler.PutFile(entryHandler, config, rateLimiter))
+	http.Handle("DELETE /{pile}/{entry}", handler.DeleteFile(entryHandler, config, rateLimiter))
 	http.Handle("POST /{pile}/", handler.PostFile(entryHandler, config, rateLimiter))
+	http.Handle("OPTIONS /{pile}/tus/", handler.TusOptions(config))
+	http.Handle("POST /{pile}/tus/", handler.TusCreate(entryHandler, config, rateLimiter))
+	http.Handle("HEAD /{pile}/tus/{upload}", handler.TusHead(entryHandler, config))
+	http.Handle("PATCH /{pile}/tus/{upload}", handler.TusPatch(entryHandler, config))
+	http.Handle("DELETE /{pile}/tus/{upload}", handler.TusDelete(entryHandler, config))
 	http.Handle("GET /{pile}/", handler.GetList(entryHandler, config, rateLimiter))
+	http.Handle("GET /{pile}/trash/", handler.GetTrash(entryHandler, config, rateLimiter))
+	http.Handle("POST /{pile}/trash/{entry}", handler.RestoreFile(entryHandler, config, rateLimiter))
+	http.Handle("PUT /{pile}/hold/{entry}", handler.HoldFile(entryHandler, config, rateLimiter, true))
+	http.Handle("DELETE /{pile}/hold/{entry}", handler.HoldFile(entryHandler, config, rateLimiter, false))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" && r.URL.Path == "/" {
 			log.Info().Str("peer", handler.DeterminePeer(config, r)).Msg("Requested /, forwarded to boltpile GitHub repo")
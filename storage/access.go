@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// In piles with sliding expiry, the lifetime of an entry counts from when it was
+// last downloaded. Writing that down on every download would have bbolt rewriting
+// pages all day long, so downloads are noted in memory, and written to the access
+// bucket in one go before looking for expired entries, and when shutting down.
+
+type accessLog struct {
+	mu      sync.Mutex
+	pending map[string]time.Time
+}
+
+func accessKey(pile string, entry string) string {
+	return pile + "/" + entry
+}
+
+func (al *accessLog) record(pile string, entry string, when time.Time) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.pending == nil {
+		al.pending = map[string]time.Time{}
+	}
+	al.pending[accessKey(pile, entry)] = when
+}
+
+func (al *accessLog) get(pile string, entry string) time.Time {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.pending[accessKey(pile, entry)]
+}
+
+func (al *accessLog) take() map[string]time.Time {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	pending := al.pending
+	al.pending = nil
+	return pending
+}
+
+// FlushAccess writes down the downloads noted since the last time.
+func (eh BoltDatabase) FlushAccess() error {
+	pending := eh.access.take()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := eh.db.Update(func(tx *bbolt.Tx) error {
+		for key, when := range pending {
+			pile, entry, _ := strings.Cut(key, "/")
+			entryMeta, err := getEntryMeta(tx, pile, entry)
+			if err != nil {
+				continue // Deleted since, so nothing to keep track of.
+			}
+			// Moving it along in the expiry index means taking it out while the old access still counts.
+			pileConfig := eh.config.Piles[pile]
+			if err := unindexExpiry(tx, pileConfig, pile, entry, entryMeta); err != nil {
+				return err
+			}
+			if err := tx.Bucket(accessBucket).Put([]byte(key), binary.LittleEndian.AppendUint64(nil, uint64(when.UnixNano()))); err != nil {
+				return err
+			}
+			if _, err := indexExpiry(tx, pileConfig, pile, entry, entryMeta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Put them back, unless there's been a newer download since.
+		for key, when := range pending {
+			pile, entry, _ := strings.Cut(key, "/")
+			if eh.access.get(pile, entry).IsZero() {
+				eh.access.record(pile, entry, when)
+			}
+		}
+	}
+	return err
+}
+
+// lastAccess is when the entry was last downloaded, as far as the database knows.
+func lastAccess(tx *bbolt.Tx, pile string, entry string) time.Time {
+	value := tx.Bucket(accessBucket).Get([]byte(accessKey(pile, entry)))
+	if len(value) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(value)))
+}
+
+func forgetAccess(tx *bbolt.Tx, pile string, entry string) error {
+	return tx.Bucket(accessBucket).Delete([]byte(accessKey(pile, entry)))
+}
+
+// withAccess fills in when the entry was last downloaded, for piles that care.
+func (eh BoltDatabase) withAccess(tx *bbolt.Tx, pile string, entry string, entryMeta EntryMeta) EntryMeta {
+	if !eh.config.Piles[pile].SlidingExpiry {
+		return entryMeta
+	}
+	accessed := lastAccess(tx, pile, entry)
+	if pending := eh.access.get(pile, entry); pending.After(accessed) {
+		accessed = pending
+	}
+	return entryMeta.withAccess(accessed)
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	BACKEND_FILESYSTEM = "filesystem"
+	BACKEND_MEMORY     = "memory"
+	BACKEND_S3         = "s3"
+)
+
+// BlobStore keeps the content of entries, while bbolt keeps track of what they are.
+// Keys are slash separated paths, like "pile/entry". A blob that isn't there is
+// reported with an error that satisfies errors.Is(err, fs.ErrNotExist).
+type BlobStore interface {
+	// Create starts writing a blob. It doesn't get a key until Commit, as that
+	// might depend on what was written.
+	Create() (BlobWriter, error)
+	Open(key string) (Blob, error)
+	Size(key string) (int64, error)
+	Remove(key string) error
+	// Sweep cleans up after writes that were never committed nor aborted.
+	Sweep() error
+}
+
+type BlobWriter interface {
+	io.Writer
+	// Commit puts the blob under the key, replacing whatever was there.
+	Commit(key string) error
+	Abort() error
+}
+
+type Blob interface {
+	io.ReadSeekCloser
+	Size() int64
+}
+
+func OpenBlobStore(config StorageConfig) (BlobStore, error) {
+	switch config.Backend {
+	case "", BACKEND_FILESYSTEM:
+		directory := config.Directory
+		if directory == "" {
+			directory = "piles"
+		}
+		return NewFilesystemStore(directory), nil
+	case BACKEND_MEMORY:
+		return NewMemoryStore(), nil
+	case BACKEND_S3:
+		return NewS3Store(config)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
+
+func entryKey(pile string, entry string) string {
+	return pile + "/" + entry
+}
+
+// validKey makes sure a key can't wander off to somewhere it shouldn't.
+func validKey(key string) bool {
+	if strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
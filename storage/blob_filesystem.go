@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FilesystemStore keeps each blob as a file under a directory, so "pile/entry"
+// ends up in piles/pile/entry by default.
+type FilesystemStore struct {
+	root string
+}
+
+func NewFilesystemStore(root string) FilesystemStore {
+	return FilesystemStore{root: root}
+}
+
+func (fss FilesystemStore) path(op string, key string) (string, error) {
+	if !validKey(key) {
+		return "", &fs.PathError{Op: op, Path: key, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(fss.root, filepath.FromSlash(key)), nil
+}
+
+func (fss FilesystemStore) Create() (BlobWriter, error) {
+	if err := os.MkdirAll(fss.root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	// The temporary file goes under the root, so the rename can't cross filesystems.
+	tmpFile, err := os.CreateTemp(fss.root, TEMP_PREFIX+"*")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+	return &fileBlobWriter{File: tmpFile, store: fss}, nil
+}
+
+func (fss FilesystemStore) Open(key string) (Blob, error) {
+	filename, err := fss.path("open", key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return fileBlob{File: file, size: info.Size()}, nil
+}
+
+func (fss FilesystemStore) Size(key string) (int64, error) {
+	filename, err := fss.path("stat", key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (fss FilesystemStore) Remove(key string) error {
+	filename, err := fss.path("remove", key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+func (fss FilesystemStore) Sweep() error {
+	err := filepath.WalkDir(fss.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), TEMP_PREFIX) {
+			return nil
+		}
+		log.Warn().Str("operation", "startup").Str("file", path).Msg("Removing leftovers from an interrupted upload")
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil // Nothing was ever stored, so nothing to clean.
+	}
+	return err
+}
+
+type fileBlob struct {
+	*os.File
+	size int64
+}
+
+func (fb fileBlob) Size() int64 {
+	return fb.size
+}
+
+type fileBlobWriter struct {
+	*os.File
+	store FilesystemStore
+	done  bool
+}
+
+// Commit makes sure the data is on disk before it's renamed into place, and
+// that the rename itself is on disk before reporting success.
+func (fbw *fileBlobWriter) Commit(key string) error {
+	if fbw.done {
+		return fmt.Errorf("%s: already committed or aborted", fbw.File.Name())
+	}
+	filename, err := fbw.store.path("commit", key)
+	if err != nil {
+		return err
+	}
+	fbw.done = true
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		fbw.File.Close()
+		os.Remove(fbw.File.Name())
+		return err
+	}
+	if err := fbw.File.Sync(); err != nil {
+		fbw.File.Close()
+		os.Remove(fbw.File.Name())
+		return err
+	}
+	if err := fbw.File.Close(); err != nil {
+		os.Remove(fbw.File.Name())
+		return err
+	}
+	if err := os.Rename(fbw.File.Name(), filename); err != nil {
+		os.Remove(fbw.File.Name())
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (fbw *fileBlobWriter) Abort() error {
+	if fbw.done {
+		return nil
+	}
+	fbw.done = true
+	fbw.File.Close()
+	return os.Remove(fbw.File.Name())
+}
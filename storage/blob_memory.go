@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"sync"
+)
+
+// MemoryStore keeps blobs in a map, which is handy for tests and not much else.
+type MemoryStore struct {
+	mu    *sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryStore() MemoryStore {
+	return MemoryStore{
+		mu:    &sync.RWMutex{},
+		blobs: make(map[string][]byte),
+	}
+}
+
+func (ms MemoryStore) Create() (BlobWriter, error) {
+	return &memoryBlobWriter{store: ms}, nil
+}
+
+func (ms MemoryStore) Open(key string) (Blob, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	data, ok := ms.blobs[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	return memoryBlob{Reader: bytes.NewReader(data)}, nil
+}
+
+func (ms MemoryStore) Size(key string) (int64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	data, ok := ms.blobs[key]
+	if !ok {
+		return 0, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+	return int64(len(data)), nil
+}
+
+func (ms MemoryStore) Remove(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.blobs[key]; !ok {
+		return &fs.PathError{Op: "remove", Path: key, Err: fs.ErrNotExist}
+	}
+	delete(ms.blobs, key)
+	return nil
+}
+
+func (ms MemoryStore) Sweep() error {
+	return nil
+}
+
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+func (mb memoryBlob) Close() error {
+	return nil
+}
+
+type memoryBlobWriter struct {
+	bytes.Buffer
+	store MemoryStore
+	done  bool
+}
+
+func (mbw *memoryBlobWriter) Commit(key string) error {
+	if mbw.done {
+		return fmt.Errorf("%s: already committed or aborted", key)
+	}
+	if !validKey(key) {
+		return &fs.PathError{Op: "commit", Path: key, Err: fs.ErrInvalid}
+	}
+	mbw.done = true
+	mbw.store.mu.Lock()
+	defer mbw.store.mu.Unlock()
+	mbw.store.blobs[key] = mbw.Bytes()
+	return nil
+}
+
+func (mbw *memoryBlobWriter) Abort() error {
+	mbw.done = true
+	mbw.Reset()
+	return nil
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long S3 gets to start answering a request. Sending the body of an upload
+// doesn't count, as big ones can take however long they take.
+const S3_RESPONSE_TIMEOUT = time.Minute
+
+// S3Store keeps blobs as objects in a bucket of anything that speaks the S3 REST API,
+// addressed path style (endpoint/bucket/prefix/key), which is what MinIO prefers.
+// Blobs are written to a local staging file first, as S3 wants to know the length
+// and checksum of an object up front. The configured directory is where those go.
+type S3Store struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	creds    SigV4Credentials
+	client   *http.Client
+	staging  string
+}
+
+func NewS3Store(config StorageConfig) (S3Store, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return S3Store{}, errors.New("the s3 backend needs both an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return S3Store{}, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	creds := SigV4Credentials{
+		AccessKey: config.AccessKey,
+		SecretKey: config.SecretKey,
+		Region:    config.Region,
+		Service:   "s3",
+	}
+	if creds.AccessKey == "" {
+		creds.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if creds.SecretKey == "" {
+		creds.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if creds.Region == "" {
+		creds.Region = "us-east-1"
+	}
+	staging := config.Directory
+	if staging == "" {
+		staging = UPLOAD_DIRECTORY
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = S3_RESPONSE_TIMEOUT
+	return S3Store{
+		endpoint: endpoint,
+		bucket:   config.Bucket,
+		prefix:   strings.Trim(config.Prefix, "/"),
+		creds:    creds,
+		client:   &http.Client{Transport: transport},
+		staging:  staging,
+	}, nil
+}
+
+func (s3 S3Store) objectURL(key string) *url.URL {
+	object := key
+	if s3.prefix != "" {
+		object = s3.prefix + "/" + key
+	}
+	u := *s3.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s3.bucket + "/" + object
+	u.RawPath = uriEncodePath(u.Path)
+	return &u
+}
+
+func (s3 S3Store) do(method string, key string, body io.Reader, payloadHash string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s3.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if rsc, ok := body.(io.ReadSeeker); ok && body != nil {
+		size, err := rsc.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rsc.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Body = io.NopCloser(rsc)
+	}
+	s3.creds.Sign(req, payloadHash, time.Now())
+	return s3.client.Do(req)
+}
+
+// s3Error turns a response we didn't like into an error, with fs.ErrNotExist for 404s.
+func s3Error(op string, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &fs.PathError{Op: op, Path: key, Err: fmt.Errorf("s3 said %s: %s", resp.Status, detail)}
+}
+
+func (s3 S3Store) Create() (BlobWriter, error) {
+	if err := os.MkdirAll(s3.staging, os.ModePerm); err != nil {
+		return nil, err
+	}
+	tmpFile, err := os.CreateTemp(s3.staging, TEMP_PREFIX+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobWriter{store: s3, file: tmpFile, hash: sha256.New()}, nil
+}
+
+func (s3 S3Store) Open(key string) (Blob, error) {
+	size, err := s3.Size(key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Blob{store: s3, key: key, size: size}, nil
+}
+
+func (s3 S3Store) Size(key string) (int64, error) {
+	resp, err := s3.do(http.MethodHead, key, nil, EMPTY_SHA256, nil)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error("stat", key, resp)
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Remove checks that the object is there first, as S3 is happy to delete nothing at all.
+func (s3 S3Store) Remove(key string) error {
+	if _, err := s3.Size(key); err != nil {
+		return err
+	}
+	resp, err := s3.do(http.MethodDelete, key, nil, EMPTY_SHA256, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("remove", key, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s3 S3Store) Sweep() error {
+	leftovers, err := filepath.Glob(filepath.Join(s3.staging, TEMP_PREFIX+"*"))
+	if err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		log.Warn().Str("operation", "startup").Str("file", leftover).Msg("Removing leftovers from an interrupted upload")
+		if err := os.Remove(leftover); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type s3BlobWriter struct {
+	store S3Store
+	file  *os.File
+	hash  hash.Hash
+	done  bool
+}
+
+func (w *s3BlobWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *s3BlobWriter) Commit(key string) error {
+	if w.done {
+		return fmt.Errorf("%s: already committed or aborted", key)
+	}
+	if !validKey(key) {
+		return &fs.PathError{Op: "commit", Path: key, Err: fs.ErrInvalid}
+	}
+	w.done = true
+	defer os.Remove(w.file.Name())
+	defer w.file.Close()
+
+	resp, err := w.store.do(http.MethodPut, key, w.file, hex.EncodeToString(w.hash.Sum(nil)), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("commit", key, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *s3BlobWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+// s3Blob reads an object with ranged GETs, starting a new one whenever it's
+// asked to read from somewhere other than where the last one left off.
+type s3Blob struct {
+	store    S3Store
+	key      string
+	size     int64
+	position int64
+	body     io.ReadCloser
+}
+
+func (b *s3Blob) Size() int64 {
+	return b.size
+}
+
+func (b *s3Blob) Read(p []byte) (int, error) {
+	if b.position >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(b.position, 10) + "-"}}
+		resp, err := b.store.do(http.MethodGet, b.key, nil, EMPTY_SHA256, header)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			return 0, s3Error("read", b.key, resp)
+		}
+		if resp.StatusCode == http.StatusOK && b.position > 0 {
+			// Didn't care for our Range header, so skip ahead the hard way.
+			if _, err := io.CopyN(io.Discard, resp.Body, b.position); err != nil {
+				resp.Body.Close()
+				return 0, err
+			}
+		}
+		b.body = resp.Body
+	}
+	n, err := b.body.Read(p)
+	b.position += int64(n)
+	return n, err
+}
+
+func (b *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	position := b.position
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position += offset
+	case io.SeekEnd:
+		position = b.size + offset
+	}
+	if position < 0 {
+		return b.position, errors.New("seek to before the start of the object")
+	}
+	if position != b.position && b.body != nil {
+		b.body.Close()
+		b.body = nil
+	}
+	b.position = position
+	return position, nil
+}
+
+func (b *s3Blob) Close() error {
+	if b.body != nil {
+		return b.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package storage_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+// fakeS3 is just enough of an S3 server to hold objects in memory.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), storage.SIGV4_ALGORITHM+" ") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, found := f.objects[r.URL.Path]
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(body)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = body
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(string(object)))
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	blobs, err := storage.NewS3Store(storage.StorageConfig{
+		Backend:   storage.BACKEND_S3,
+		Directory: t.TempDir(),
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		Prefix:    "boltpile",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("new s3 store: %s", err)
+	}
+	testBlobStore(t, blobs)
+
+	writer, err := blobs.Create()
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	writer.Write([]byte("kept"))
+	if err := writer.Commit("pile/kept"); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if _, ok := fake.objects["/bucket/boltpile/pile/kept"]; !ok {
+		t.Errorf("object not stored under the bucket and prefix")
+	}
+}
@@ -0,0 +1,88 @@
+package storage_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+func testBlobStore(t *testing.T, blobs storage.BlobStore) {
+	writer, err := blobs.Create()
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := writer.Write([]byte("dummy content")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if _, err := blobs.Open("pile/entry"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("blob visible before commit (err: %v)", err)
+	}
+	if err := writer.Commit("pile/entry"); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+
+	blob, err := blobs.Open("pile/entry")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if blob.Size() != 13 {
+		t.Errorf("size %d != 13", blob.Size())
+	}
+	if _, err := blob.Seek(6, io.SeekStart); err != nil {
+		t.Errorf("seek: %s", err)
+	}
+	content, err := io.ReadAll(blob)
+	if err != nil {
+		t.Errorf("read: %s", err)
+	}
+	if string(content) != "content" {
+		t.Errorf("%q != %q", "content", content)
+	}
+	blob.Close()
+
+	size, err := blobs.Size("pile/entry")
+	if err != nil || size != 13 {
+		t.Errorf("size: %d, %v", size, err)
+	}
+
+	aborted, err := blobs.Create()
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	aborted.Write([]byte("never mind"))
+	if err := aborted.Abort(); err != nil {
+		t.Errorf("abort: %s", err)
+	}
+	if _, err := blobs.Size("pile/aborted"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("aborted blob exists (err: %v)", err)
+	}
+
+	if err := blobs.Remove("pile/entry"); err != nil {
+		t.Errorf("remove: %s", err)
+	}
+	if err := blobs.Remove("pile/entry"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("removed twice (err: %v)", err)
+	}
+
+	for _, key := range []string{"../escape", "pile/../../escape", "/absolute", "pile//entry"} {
+		writer, err := blobs.Create()
+		if err != nil {
+			t.Fatalf("create: %s", err)
+		}
+		if err := writer.Commit(key); err == nil {
+			t.Errorf("%q was accepted as a key", key)
+		}
+		writer.Abort()
+	}
+}
+
+func TestFilesystemStore(t *testing.T) {
+	testBlobStore(t, storage.NewFilesystemStore(t.TempDir()))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testBlobStore(t, storage.NewMemoryStore())
+}
@@ -1,9 +1,10 @@
 package storage
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"net/http"
-	"os"
-	"path"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,58 +13,177 @@ import (
 )
 
 type BoltDatabase struct {
-	db *bbolt.DB
+	db       *bbolt.DB
+	blobs    BlobStore
+	config   Config
+	keyrings map[string]*keyring
+	uploads  *uploadLocks
+	access   *accessLog
+	alarm    *expiryAlarm
+	disk     *diskMonitor
 }
 
-func MustOpenBoltDatabase(filename string) BoltDatabase {
+func OpenBoltDatabase(filename string, config Config, blobs BlobStore) (BoltDatabase, error) {
+	keyrings, err := loadKeyrings(config)
+	if err != nil {
+		return BoltDatabase{}, err
+	}
 	db, err := bbolt.Open(filename, 0600, nil)
+	if err != nil {
+		return BoltDatabase{}, err
+	}
+	if err := db.Update(createInternalBuckets); err != nil {
+		db.Close()
+		return BoltDatabase{}, err
+	}
+	return BoltDatabase{db: db, blobs: blobs, config: config, keyrings: keyrings, uploads: &uploadLocks{}, access: &accessLog{}, alarm: newExpiryAlarm(), disk: newDiskMonitor(config.DataDirectory())}, nil
+}
+
+func MustOpenBoltDatabase(filename string, config Config) BoltDatabase {
+	blobs, err := OpenBlobStore(config.Storage)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not open blob storage")
+	}
+	eh, err := OpenBoltDatabase(filename, config, blobs)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not open bbolt file")
 	}
-	return BoltDatabase{db: db}
+	return eh
+}
+
+// DB is for the maintenance functions that work directly on the database.
+func (eh BoltDatabase) DB() *bbolt.DB {
+	return eh.db
+}
+
+func (eh BoltDatabase) Close() error {
+	if err := eh.FlushAccess(); err != nil {
+		log.Error().Err(err).Msg("Could not write down the last downloads")
+	}
+	return eh.db.Close()
 }
+
 func (eh BoltDatabase) GetEntry(pile string, entry string, get GetWithFunc) error {
+	limited := false
+	// Turning someone away, or telling them they already have it, isn't a download.
+	tracker := &readTracker{}
 	err := eh.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(pile))
-		if bucket == nil {
-			return ErrNoSuchPile{pile}
+		entryMeta, err := eh.getLiveEntryMeta(tx, pile, entry)
+		if err != nil {
+			return err
 		}
-		value := bucket.Get([]byte(entry))
-		if value == nil {
+		if entryMeta.IsLimited() {
+			limited = true // Needs writing to, so it's dealt with outside this transaction.
+			return nil
+		}
+		return eh.serveEntry(pile, entry, eh.withAccess(tx, pile, entry, entryMeta), get, tracker)
+	})
+	if err == nil && limited {
+		err = eh.getLimitedEntry(pile, entry, get, tracker)
+	}
+	if err == nil && tracker.read && eh.config.Piles[pile].SlidingExpiry {
+		eh.access.record(pile, entry, time.Now())
+	}
+	return err
+}
+
+// serveEntry opens up the content of an entry and hands it to get. If there's a
+// tracker, it takes note of whether any content was actually read.
+func (eh BoltDatabase) serveEntry(pile string, entry string, entryMeta EntryMeta, get GetWithFunc, tracker *readTracker) error {
+	blob, err := eh.blobs.Open(blobKey(pile, entry, entryMeta))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			return ErrNoSuchEntry{Pile: pile, Entry: entry}
 		}
-		entryMeta, err := EntryMetaFromBytes(value)
-		if err != nil {
-			return ErrUnparsableMeta{Raw: value, ParseError: err}
+		return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	defer blob.Close()
+	file := blob
+	if tracker != nil {
+		tracker.Blob = file
+		file = tracker
+	}
+
+	stored := file
+	if entryMeta.KeyID() != "" {
+		if stored, err = eh.openSealed(pile, entry, entryMeta, file); err != nil {
+			return err
 		}
+	}
+	var content io.ReadSeeker = stored
+	if entryMeta.Codec() != "" {
+		decoder := newDecodingReader(stored, entryMeta.Codec(), entryMeta.Size())
+		defer decoder.Close()
+		content = decoder
+	}
 
-		file, err := os.Open(path.Join("piles", pile, entry))
-		if err != nil {
-			if os.IsNotExist(err) {
-				return ErrNoSuchEntry{Pile: pile, Entry: entry}
-			}
+	MIMEType := entryMeta.ContentType()
+	if !entryMeta.HasContentInfo() {
+		// A peek for the MIME type goes around the tracker, as it's not the client reading.
+		buf := make([]byte, 512)
+		read, err := blob.Read(buf)
+		if err != nil && err != io.EOF {
 			return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
 		}
+		MIMEType = http.DetectContentType(buf[:read])
+		if _, err := blob.Seek(0, io.SeekStart); err != nil {
+			return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+	}
 
-		buf := make([]byte, 512)
-		read, err := file.Read(buf)
+	err = get(entryMeta, MIMEType, content)
+	if err != nil {
+		return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	return nil
+}
+
+// StatEntry is GetEntry without the file, for when only the headers are wanted.
+// Entries from before size and MIME type were recorded still need a peek at the content.
+// GetEntryMeta is what's known about a live entry, without touching the content.
+// It's for deciding who gets it before opening it up, which might take a while.
+func (eh BoltDatabase) GetEntryMeta(pile string, entry string) (EntryMeta, error) {
+	entryMeta := EntryMeta{}
+	err := eh.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		entryMeta, err = eh.getLiveEntryMeta(tx, pile, entry)
+		return err
+	})
+	return entryMeta, err
+}
+
+func (eh BoltDatabase) StatEntry(pile string, entry string, stat StatWithFunc) error {
+	return eh.db.View(func(tx *bbolt.Tx) error {
+		entryMeta, err := eh.getLiveEntryMeta(tx, pile, entry)
 		if err != nil {
-			return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+			return err
 		}
-		MIMEType := http.DetectContentType(buf[:read])
-		file.Seek(0, 0)
 
-		err = get(entryMeta, MIMEType, file)
+		key := blobKey(pile, entry, entryMeta)
+		blobSize, err := eh.blobs.Size(key)
 		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return ErrNoSuchEntry{Pile: pile, Entry: entry}
+			}
 			return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
 		}
-		err = file.Close()
+
+		MIMEType := entryMeta.ContentType()
+		size := entryMeta.Size()
+		if !entryMeta.HasContentInfo() {
+			size = blobSize
+			MIMEType, err = eh.sniffBlob(key)
+			if err != nil {
+				return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+			}
+		}
+
+		err = stat(entryMeta, MIMEType, size)
 		if err != nil {
 			return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
 		}
 		return nil
 	})
-	return err
 }
 func (eh BoltDatabase) GetPileEntries(pile string) (map[string]EntryMeta, error) {
 	entries := make(map[string]EntryMeta)
@@ -77,60 +197,417 @@ func (eh BoltDatabase) GetPileEntries(pile string) (map[string]EntryMeta, error)
 			if err != nil {
 				return err
 			}
-			entries[string(name)] = meta
+			entries[string(name)] = eh.withAccess(tx, pile, string(name), meta)
 			return nil
 		})
 		return nil
 	})
 	return entries, err
 }
-func (eh BoltDatabase) CreateEntry(pile string, filename string, create CreateWithFunc) (string, error) {
-	id, err := uuid.NewRandom()
+func (eh BoltDatabase) CreateEntry(pile string, upload UploadInfo, create CreateWithFunc) (string, error) {
+	pileConfig, err := eh.config.Pile(pile)
 	if err != nil {
-		return "", ErrFailedMakingId{err}
+		return "", err
+	}
+	if err := eh.checkDisk(pile); err != nil {
+		return "", err
 	}
-	entry := id.String()
 
-	return entry, eh.db.Update(func(tx *bbolt.Tx) error {
+	entry := ""
+	if pileConfig.UseFilename {
+		entry, err = SanitizeFilename(upload.Filename)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return "", ErrFailedMakingId{err}
+		}
+		entry = id.String()
+	}
+
+	meta, err := uploadMeta(pileConfig, pile, entry, upload)
+	if err != nil {
+		return "", err
+	}
+
+	// No point in taking the whole upload if the name is already spoken for, or it won't fit.
+	pick := func(tx *bbolt.Tx) (string, error) {
 		bucket := tx.Bucket([]byte(pile))
 		if bucket == nil {
-			return ErrNoSuchPile{pile}
+			return "", ErrNoSuchPile{pile}
 		}
-		if err := os.MkdirAll(path.Join("piles", pile), os.ModePerm); err != nil {
-			return ErrFailedCreatingPileDirectory{Pile: pile, UpstreamError: err}
+		if !pileConfig.UseFilename {
+			return entry, nil
 		}
-		dstFile, err := os.Create(path.Join("piles", pile, entry))
+		return pickFilenameEntry(bucket, pile, entry, pileConfig.Collision)
+	}
+	err = eh.db.View(func(tx *bbolt.Tx) error {
+		picked, err := pick(tx)
 		if err != nil {
-			return ErrFailedCreatingEntryFile{Pile: pile, Entry: entry, UpstreamError: err}
+			return err
 		}
-		err = create(entry, dstFile)
-		if err != nil {
-			dstFile.Close() // ... and hope for the best, I guess XD
-			return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+		if err := refuseHeld(tx, pile, picked); err != nil {
+			return err
 		}
+		return checkRoom(tx, pileConfig, pile, picked, upload.Length)
+	})
+	if err != nil {
+		return "", err
+	}
 
-		if err := dstFile.Close(); err != nil {
-			return ErrFailedCreatingEntryFile{Pile: pile, Entry: entry, UpstreamError: err}
-		}
+	writer, recorder, err := eh.writeBlob(pile, entry, pileConfig.Compression, create)
+	if err != nil {
+		return "", err
+	}
+	defer writer.Abort() // Does nothing once committed.
+	meta = recorder.Meta(meta, upload.ContentType)
 
-		meta := NewEntryMeta(filename, time.Now().UTC())
-		metaBytes, err := meta.Bytes()
+	// Something else might have taken the name while we were busy writing.
+	err = eh.storeEntry(pile, entry, meta, writer, func(tx *bbolt.Tx) error {
+		picked, err := pick(tx)
 		if err != nil {
-			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+			return err
+		}
+		if err := refuseHeld(tx, pile, picked); err != nil {
+			return err
 		}
+		if err := eh.makeRoom(tx, pileConfig, pile, picked, meta.Size()); err != nil {
+			return err
+		}
+		if err := eh.putEntry(tx, pile, picked, meta); err != nil {
+			return err
+		}
+		entry = picked
+		return nil
+	})
+	return entry, err
+}
 
-		if err := bucket.Put([]byte(entry), metaBytes); err != nil {
-			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+func (eh BoltDatabase) ReplaceEntry(pile string, entry string, upload UploadInfo, create CreateWithFunc) error {
+	pileConfig, err := eh.config.Pile(pile)
+	if err != nil {
+		return err
+	}
+	if err := eh.checkDisk(pile); err != nil {
+		return err
+	}
+	// Likewise, before taking the upload.
+	err = eh.db.View(func(tx *bbolt.Tx) error {
+		if err := entryExists(tx, pile, entry); err != nil {
+			return err
+		}
+		if err := refuseHeld(tx, pile, entry); err != nil {
+			return err
 		}
+		return checkRoom(tx, pileConfig, pile, entry, upload.Length)
+	})
+	if err != nil {
+		return err
+	}
+
+	meta, err := uploadMeta(pileConfig, pile, entry, upload)
+	if err != nil {
+		return err
+	}
+	writer, recorder, err := eh.writeBlob(pile, entry, pileConfig.Compression, create)
+	if err != nil {
+		return err
+	}
+	defer writer.Abort() // Does nothing once committed.
+	meta = recorder.Meta(meta, upload.ContentType)
 
+	return eh.storeEntry(pile, entry, meta, writer, func(tx *bbolt.Tx) error {
+		// Someone might have deleted or held it while we were busy writing.
+		if err := entryExists(tx, pile, entry); err != nil {
+			return err
+		}
+		if err := refuseHeld(tx, pile, entry); err != nil {
+			return err
+		}
+		// New content doesn't mean it's fine to let anyone have it now.
+		if !meta.HasPassword() {
+			if previous, err := EntryMetaFromBytes(tx.Bucket([]byte(pile)).Get([]byte(entry))); err == nil {
+				meta = meta.withPasswordHash(previous.password)
+			}
+		}
+		if err := eh.makeRoom(tx, pileConfig, pile, entry, meta.Size()); err != nil {
+			return err
+		}
+		return eh.putEntry(tx, pile, entry, meta)
+	})
+}
+func (eh BoltDatabase) DeleteEntry(pile string, entry string) error {
+	return eh.db.Update(func(tx *bbolt.Tx) error {
+		if err := entryExists(tx, pile, entry); err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte(pile))
+		value := bucket.Get([]byte(entry))
+		entryMeta, err := EntryMetaFromBytes(value)
+		if err != nil {
+			return ErrUnparsableMeta{Raw: value, ParseError: err}
+		}
+		if entryMeta.IsHeld() {
+			return ErrEntryHeld{Pile: pile, Entry: entry}
+		}
+		prune, err := bury(tx, eh.config, pile, entry, entryMeta, TOMBSTONE_DELETED, time.Now())
+		if err != nil {
+			return ErrFailedDeletingEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		eh.alarm.consider(prune)
+		if entryMeta.IsExhausted() {
+			return nil // Whoever got the last download takes care of the content.
+		}
+		// The content goes last, so that a failure here rolls back the metadata removal.
+		purge, err := discard(tx, eh.config, eh.blobs, pile, entry, entryMeta, TOMBSTONE_DELETED, time.Now())
+		eh.alarm.consider(purge)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+			}
+			log.Warn().Str("operation", "delete").Str("pile", pile).Str("entry", entry).Msg("Deleted file already doesn't exist!")
+		}
 		return nil
 	})
 }
 func (eh BoltDatabase) Startup(config Config) error {
-	err := Startup(config, eh.db)
+	err := Startup(config, eh.db, eh.blobs)
 	if err != nil {
 		return err
 	}
-	StartExpireLoop(5*time.Minute, config, eh.db)
+	if err := eh.blobs.Sweep(); err != nil {
+		return err
+	}
+	eh.watchDisk()
+	eh.StartExpireLoop(5 * time.Minute)
 	return nil
 }
+
+func getEntryMeta(tx *bbolt.Tx, pile string, entry string) (EntryMeta, error) {
+	bucket := tx.Bucket([]byte(pile))
+	if bucket == nil {
+		return EntryMeta{}, ErrNoSuchPile{pile}
+	}
+	value := bucket.Get([]byte(entry))
+	if value == nil {
+		return EntryMeta{}, ErrNoSuchEntry{Pile: pile, Entry: entry}
+	}
+	entryMeta, err := EntryMetaFromBytes(value)
+	if err != nil {
+		return entryMeta, ErrUnparsableMeta{Raw: value, ParseError: err}
+	}
+	return entryMeta, nil
+}
+
+// getLiveEntryMeta is getEntryMeta for entries that can be downloaded, with when they
+// were last, if that matters. Those that can't, or just used to be there, are gone.
+func (eh BoltDatabase) getLiveEntryMeta(tx *bbolt.Tx, pile string, entry string) (EntryMeta, error) {
+	entryMeta, err := getEntryMeta(tx, pile, entry)
+	if err != nil {
+		return entryMeta, gone(tx, pile, entry, err)
+	}
+	if entryMeta.IsExhausted() {
+		return entryMeta, ErrEntryGone{Pile: pile, Entry: entry, Reason: TOMBSTONE_DOWNLOADED, Time: time.Now().UTC()}
+	}
+	entryMeta = eh.withAccess(tx, pile, entry, entryMeta)
+	if expires := entryMeta.Expires(eh.config.Piles[pile].Lifetime.Duration); !expires.IsZero() && time.Now().After(expires) {
+		return entryMeta, ErrEntryGone{Pile: pile, Entry: entry, Reason: TOMBSTONE_EXPIRED, Time: expires.UTC()}
+	}
+	return entryMeta, nil
+}
+
+func putEntryMeta(tx *bbolt.Tx, pile string, entry string, entryMeta EntryMeta) error {
+	metaBytes, err := entryMeta.Bytes()
+	if err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	if err := tx.Bucket([]byte(pile)).Put([]byte(entry), metaBytes); err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	return nil
+}
+
+func entryExists(tx *bbolt.Tx, pile string, entry string) error {
+	bucket := tx.Bucket([]byte(pile))
+	if bucket == nil {
+		return ErrNoSuchPile{pile}
+	}
+	if bucket.Get([]byte(entry)) == nil {
+		return ErrNoSuchEntry{Pile: pile, Entry: entry}
+	}
+	return nil
+}
+
+// uploadMeta is what's known about an entry before any content is stored. Hashing
+// the password takes a while, so this should be done outside of any transaction.
+func uploadMeta(pileConfig PileConfig, pile string, entry string, upload UploadInfo) (EntryMeta, error) {
+	// Stored to the second anyway, and the expiry index needs to agree with what's stored.
+	meta := NewEntryMeta(upload.Filename, time.Now().UTC().Truncate(time.Second)).WithPeer(upload.Peer)
+	if upload.Lifetime != 0 {
+		if !pileConfig.AllowsLifetime(upload.Lifetime) {
+			return meta, ErrUnacceptableLifetime{Pile: pile, Lifetime: upload.Lifetime}
+		}
+		meta = meta.WithExpiry(meta.Time().Add(upload.Lifetime))
+	}
+	if upload.Downloads > 0 {
+		meta = meta.WithDownloads(upload.Downloads)
+	}
+	if upload.passwordHash != nil {
+		return meta.withPasswordHash(upload.passwordHash), nil
+	}
+	if upload.Password == "" {
+		return meta, nil
+	}
+	hash, err := hashPassword(upload.Password)
+	if err != nil {
+		return meta, ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	return meta.withPasswordHash(hash), nil
+}
+
+// blobKey is where the content of an entry is kept in the BlobStore.
+func blobKey(pile string, entry string, meta EntryMeta) string {
+	if meta.Blob() != "" {
+		return meta.Blob()
+	}
+	return entryKey(pile, entry)
+}
+
+// writeBlob has create fill a new blob, noting what passes through. The caller
+// commits it when the metadata is in place, or aborts it if anything went wrong.
+func (eh BoltDatabase) writeBlob(pile string, entry string, codec string, create CreateWithFunc) (BlobWriter, *contentRecorder, error) {
+	writer, err := eh.blobs.Create()
+	if err != nil {
+		return nil, nil, ErrFailedCreatingEntryFile{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	var key encryptionKey
+	if kr := eh.keyrings[pile]; kr != nil {
+		key = kr.current
+	}
+	recorder, err := newContentRecorder(writer, codec, key)
+	if err != nil {
+		writer.Abort()
+		return nil, nil, ErrFailedCreatingEntryFile{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	if err := create(entry, recorder); err != nil {
+		writer.Abort()
+		return nil, nil, ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	if err := recorder.Close(); err != nil {
+		writer.Abort()
+		return nil, nil, ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	return writer, recorder, nil
+}
+
+// openSealed decrypts the content of an entry as it's read.
+func (eh BoltDatabase) openSealed(pile string, entry string, meta EntryMeta, blob Blob) (Blob, error) {
+	kr := eh.keyrings[pile]
+	if kr == nil {
+		return nil, ErrMissingEncryptionKey{Pile: pile, Entry: entry, KeyID: meta.KeyID()}
+	}
+	key, ok := kr.keys[meta.KeyID()]
+	if !ok {
+		return nil, ErrMissingEncryptionKey{Pile: pile, Entry: entry, KeyID: meta.KeyID()}
+	}
+	opened, err := newOpeningReader(blob, key, meta.Nonce())
+	if err != nil {
+		return nil, ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	return opened, nil
+}
+
+// storeEntry stages the content that was written for an entry, then has put store
+// the entry in a transaction of its own. If that fails, the content is let go of.
+func (eh BoltDatabase) storeEntry(pile string, entry string, meta EntryMeta, writer BlobWriter, put func(tx *bbolt.Tx) error) error {
+	key := contentKey(meta)
+	if err := stageBlob(eh.db, writer, key); err != nil {
+		return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	err := eh.db.Update(put)
+	if err != nil {
+		if err := eh.db.Update(func(tx *bbolt.Tx) error {
+			return releaseBlob(tx, eh.blobs, key)
+		}); err != nil {
+			log.Error().Err(err).Str("pile", pile).Str("entry", entry).Str("blob", key).Msg("Could not let go of content that wasn't stored")
+		}
+	}
+	return err
+}
+
+// putEntry stores the metadata of an entry, with content staged by storeEntry,
+// and lets go of whatever content the entry had before. Whether that entry may be
+// replaced at all, like when it's on hold, is for the caller to decide.
+func (eh BoltDatabase) putEntry(tx *bbolt.Tx, pile string, entry string, meta EntryMeta) error {
+	bucket := tx.Bucket([]byte(pile))
+	pileConfig := eh.config.Piles[pile]
+	previous := ""
+	if value := bucket.Get([]byte(entry)); value != nil {
+		previousMeta, err := EntryMetaFromBytes(value)
+		if err != nil {
+			log.Warn().Err(err).Str("pile", pile).Str("entry", entry).Msg("Overwriting entry with unparsable metadata")
+		} else {
+			if err := unindexExpiry(tx, pileConfig, pile, entry, previousMeta); err != nil {
+				return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+			}
+			if err := uncountEntry(tx, pile, entry, previousMeta); err != nil {
+				return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+			}
+			if !previousMeta.IsExhausted() {
+				previous = blobKey(pile, entry, previousMeta)
+			}
+		}
+	}
+
+	// Anything already in the pile keeps its place in line, like when it's re-encrypted.
+	if meta.sequence == 0 {
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		meta = meta.withSequence(sequence)
+	}
+	key := contentKey(meta)
+	metaBytes, err := meta.WithBlob(key).Bytes()
+	if err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	if err := bucket.Put([]byte(entry), metaBytes); err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	expires, err := indexExpiry(tx, pileConfig, pile, entry, meta)
+	if err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	if err := tx.Bucket(tombstonesBucket).Delete([]byte(accessKey(pile, entry))); err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	if err := countEntry(tx, pile, entry, meta); err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	eh.alarm.consider(expires)
+
+	// The new content is in, so the old is only worth a warning if it won't go away.
+	if previous != "" {
+		if err := releaseBlob(tx, eh.blobs, previous); err != nil {
+			log.Warn().Err(err).Str("pile", pile).Str("entry", entry).Str("blob", previous).Msg("Could not let go of the previous content")
+		}
+	}
+	return nil
+}
+
+func (eh BoltDatabase) sniffBlob(key string) (string, error) {
+	blob, err := eh.blobs.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+	buf := make([]byte, 512)
+	read, err := blob.Read(buf)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:read]), nil
+}
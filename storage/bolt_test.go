@@ -0,0 +1,878 @@
+package storage_test
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"go.etcd.io/bbolt"
+)
+
+func openTestDatabase(t *testing.T, config storage.Config) (storage.BoltDatabase, storage.BlobStore) {
+	blobs := storage.NewMemoryStore()
+	eh, err := storage.OpenBoltDatabase(filepath.Join(t.TempDir(), "boltpile.db"), config, blobs)
+	if err != nil {
+		t.Fatalf("opening database: %s", err)
+	}
+	t.Cleanup(func() { eh.Close() })
+	if err := storage.Startup(config, eh.DB(), blobs); err != nil {
+		t.Fatalf("startup: %s", err)
+	}
+	return eh, blobs
+}
+
+// onePile is the config of the one pile most tests need.
+func onePile(pileConfig storage.PileConfig) storage.Config {
+	return storage.Config{Piles: map[string]storage.PileConfig{"pile": pileConfig}}
+}
+
+func writeString(content string) storage.CreateWithFunc {
+	return func(id string, dst io.Writer) error {
+		_, err := io.WriteString(dst, content)
+		return err
+	}
+}
+
+// putLegacyEntry stores content the way it was before there were version 2 entries,
+// with the metadata only knowing the filename and when it was uploaded.
+func putLegacyEntry(t *testing.T, eh storage.BoltDatabase, blobs storage.BlobStore, config storage.Config, entry string, created time.Time, content string) {
+	t.Helper()
+	writer, err := blobs.Create()
+	if err != nil {
+		t.Fatalf("create blob: %s", err)
+	}
+	if _, err := io.WriteString(writer, content); err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	if err := writer.Commit("pile/" + entry); err != nil {
+		t.Fatalf("commit blob: %s", err)
+	}
+	meta := binary.LittleEndian.AppendUint64([]byte{1}, uint64(created.Unix()))
+	meta = append(meta, entry...)
+	err = eh.DB().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("pile")).Put([]byte(entry), meta)
+	})
+	if err != nil {
+		t.Fatalf("put legacy entry: %s", err)
+	}
+	// As if upgrading, which indexes what was already there.
+	if err := storage.Startup(config, eh.DB(), blobs); err != nil {
+		t.Fatalf("startup: %s", err)
+	}
+}
+
+func readEntry(t *testing.T, eh storage.BoltDatabase, pile string, entry string) (storage.EntryMeta, string, error) {
+	t.Helper()
+	var meta storage.EntryMeta
+	content := ""
+	err := eh.GetEntry(pile, entry, func(metaData storage.EntryMeta, MIMEType string, file io.ReadSeeker) error {
+		meta = metaData
+		data, err := io.ReadAll(file)
+		content = string(data)
+		return err
+	})
+	return meta, content, err
+}
+
+func TestCreateReplaceDeleteEntry(t *testing.T) {
+	eh, _ := openTestDatabase(t, onePile(storage.PileConfig{Lifetime: storage.Lifetime{Duration: time.Hour}}))
+
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "first.txt", Peer: "192.0.2.1"}, writeString("first content"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	meta, content, err := readEntry(t, eh, "pile", entry)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if content != "first content" || meta.Filename() != "first.txt" || meta.Size() != 13 || meta.Peer() != "192.0.2.1" {
+		t.Errorf("got %q from %q, size %d, peer %q", content, meta.Filename(), meta.Size(), meta.Peer())
+	}
+
+	err = eh.ReplaceEntry("pile", entry, storage.UploadInfo{Filename: "second.txt"}, writeString("second"))
+	if err != nil {
+		t.Fatalf("replace: %s", err)
+	}
+	meta, content, err = readEntry(t, eh, "pile", entry)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if content != "second" || meta.Filename() != "second.txt" {
+		t.Errorf("got %q from %q after replacing", content, meta.Filename())
+	}
+
+	if err := eh.DeleteEntry("pile", entry); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	gone := storage.ErrEntryGone{}
+	if _, _, err := readEntry(t, eh, "pile", entry); !errors.As(err, &gone) || gone.Reason != storage.TOMBSTONE_DELETED {
+		t.Errorf("expected ErrEntryGone after delete, got %v", err)
+	}
+	if err := eh.DeleteEntry("pile", entry); !errors.As(err, &storage.ErrNoSuchEntry{}) {
+		t.Errorf("expected ErrNoSuchEntry deleting twice, got %v", err)
+	}
+}
+
+func TestCreateEntryFailureLeavesNothing(t *testing.T) {
+	eh, _ := openTestDatabase(t, onePile(storage.PileConfig{Lifetime: storage.Lifetime{Duration: time.Hour}}))
+
+	_, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "broken.txt"}, func(id string, dst io.Writer) error {
+		io.WriteString(dst, "half of it")
+		return errors.New("connection lost")
+	})
+	if !errors.As(err, &storage.ErrDuringFileOperation{}) {
+		t.Errorf("expected ErrDuringFileOperation, got %v", err)
+	}
+	entries, err := eh.GetPileEntries("pile")
+	if err != nil {
+		t.Fatalf("listing: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d entries left behind by a failed upload", len(entries))
+	}
+}
+
+func TestCreateEntryFilenameCollisions(t *testing.T) {
+	eh, _ := openTestDatabase(t, onePile(storage.PileConfig{UseFilename: true, Collision: storage.COLLISION_SUFFIX}))
+	names := []string{}
+	for range 3 {
+		entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "../report.pdf"}, writeString("report"))
+		if err != nil {
+			t.Fatalf("create: %s", err)
+		}
+		names = append(names, entry)
+	}
+	if strings.Join(names, ",") != "report.pdf,report-1.pdf,report-2.pdf" {
+		t.Errorf("unexpected entry names %v", names)
+	}
+}
+
+func TestIdenticalContentIsStoredOnce(t *testing.T) {
+	config := storage.Config{Piles: map[string]storage.PileConfig{"pile": {}, "other": {}}}
+	eh, blobs := openTestDatabase(t, config)
+
+	first, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "installer.exe"}, writeString("same old"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	second, err := eh.CreateEntry("other", storage.UploadInfo{Filename: "setup.exe"}, writeString("same old"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	firstMeta, _, _ := readEntry(t, eh, "pile", first)
+	secondMeta, _, _ := readEntry(t, eh, "other", second)
+	if firstMeta.Blob() == "" || firstMeta.Blob() != secondMeta.Blob() {
+		t.Fatalf("identical content in blobs %q and %q", firstMeta.Blob(), secondMeta.Blob())
+	}
+
+	if err := eh.DeleteEntry("pile", first); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, content, err := readEntry(t, eh, "other", second); err != nil || content != "same old" {
+		t.Errorf("remaining entry got %q, %v", content, err)
+	}
+	if err := eh.DeleteEntry("other", second); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := blobs.Size(secondMeta.Blob()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("blob still around after the last entry using it was deleted (err: %v)", err)
+	}
+}
+
+func TestUnconfiguredPileReleasesBlobs(t *testing.T) {
+	config := storage.Config{Piles: map[string]storage.PileConfig{"pile": {}, "other": {}}}
+	eh, blobs := openTestDatabase(t, config)
+
+	kept, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "shared.txt"}, writeString("in both"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := eh.CreateEntry("other", storage.UploadInfo{Filename: "shared.txt"}, writeString("in both")); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	only, err := eh.CreateEntry("other", storage.UploadInfo{Filename: "only.txt"}, writeString("only here"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	onlyMeta, _, _ := readEntry(t, eh, "other", only)
+
+	if err := storage.Startup(onePile(storage.PileConfig{}), eh.DB(), blobs); err != nil {
+		t.Fatalf("startup without the other pile: %s", err)
+	}
+	if _, err := blobs.Size(onlyMeta.Blob()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("blob of the dropped pile still around (err: %v)", err)
+	}
+	keptMeta, content, err := readEntry(t, eh, "pile", kept)
+	if err != nil || content != "in both" {
+		t.Fatalf("shared entry got %q, %v", content, err)
+	}
+	// The configured pile had the last reference to it.
+	if err := eh.DeleteEntry("pile", kept); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := blobs.Size(keptMeta.Blob()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("shared blob still around after the last entry using it was deleted (err: %v)", err)
+	}
+}
+
+func TestRejectedContentIsNotKept(t *testing.T) {
+	eh, blobs := openTestDatabase(t, onePile(storage.PileConfig{MaxEntries: 1}))
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "kept.txt"}, writeString("same old"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "copy.txt"}, writeString("same old")); !errors.As(err, &storage.ErrPileFull{}) {
+		t.Fatalf("expected ErrPileFull, got %v", err)
+	}
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "other.txt"}, writeString("something else")); !errors.As(err, &storage.ErrPileFull{}) {
+		t.Fatalf("expected ErrPileFull, got %v", err)
+	}
+	sum := sha256.Sum256([]byte("something else"))
+	other := hex.EncodeToString(sum[:])
+	if _, err := blobs.Size("content/" + other[:2] + "/" + other); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("content of a rejected upload was kept (err: %v)", err)
+	}
+
+	meta, content, err := readEntry(t, eh, "pile", entry)
+	if err != nil || content != "same old" {
+		t.Fatalf("entry sharing content with a rejected upload got %q, %v", content, err)
+	}
+	if err := eh.DeleteEntry("pile", entry); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := blobs.Size(meta.Blob()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the rejected upload is still counted as using the content (err: %v)", err)
+	}
+}
+
+func TestCompressedEntries(t *testing.T) {
+	content := strings.Repeat("log line that compresses rather well\n", 1000)
+	for _, codec := range []string{storage.CODEC_GZIP, storage.CODEC_ZSTD} {
+		t.Run(codec, func(t *testing.T) {
+			eh, _ := openTestDatabase(t, onePile(storage.PileConfig{Compression: codec}))
+			entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "app.log"}, writeString(content))
+			if err != nil {
+				t.Fatalf("create: %s", err)
+			}
+
+			err = eh.GetEntry("pile", entry, func(meta storage.EntryMeta, MIMEType string, file io.ReadSeeker) error {
+				if meta.Codec() != codec || meta.Size() != int64(len(content)) || meta.StoredSize() >= meta.Size() {
+					t.Errorf("codec %q, size %d, stored size %d", meta.Codec(), meta.Size(), meta.StoredSize())
+				}
+				if _, err := file.Seek(-5, io.SeekEnd); err != nil {
+					return err
+				}
+				tail, err := io.ReadAll(file)
+				if err != nil {
+					return err
+				}
+				if string(tail) != "well\n" {
+					t.Errorf("read %q from the end", tail)
+				}
+				if _, err := file.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				all, err := io.ReadAll(file)
+				if err != nil {
+					return err
+				}
+				if string(all) != content {
+					t.Errorf("decompressed content differs from the original")
+				}
+
+				compressed, ok := file.(storage.CompressedContent)
+				if !ok {
+					t.Fatalf("%T is not CompressedContent", file)
+				}
+				raw, err := compressed.Compressed()
+				if err != nil {
+					return err
+				}
+				stored, err := io.ReadAll(raw)
+				if int64(len(stored)) != meta.StoredSize() {
+					t.Errorf("got %d compressed bytes, expected %d", len(stored), meta.StoredSize())
+				}
+				return err
+			})
+			if err != nil {
+				t.Errorf("get: %s", err)
+			}
+		})
+	}
+}
+
+func TestPasswordProtectedEntry(t *testing.T) {
+	eh, _ := openTestDatabase(t, onePile(storage.PileConfig{}))
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "contract.pdf", Password: "hunter2"}, writeString("sign here"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	meta, _, err := readEntry(t, eh, "pile", entry)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !meta.HasPassword() || !meta.CheckPassword("hunter2") || meta.CheckPassword("hunter3") {
+		t.Errorf("password not stored right")
+	}
+
+	checked, err := eh.GetEntryMeta("pile", entry)
+	if err != nil || !checked.SamePassword(meta) {
+		t.Fatalf("get meta: same password %t, %v", checked.SamePassword(meta), err)
+	}
+
+	if err := eh.ReplaceEntry("pile", entry, storage.UploadInfo{Filename: "contract-v2.pdf"}, writeString("sign here, too")); err != nil {
+		t.Fatalf("replace: %s", err)
+	}
+	meta, _, _ = readEntry(t, eh, "pile", entry)
+	if !meta.CheckPassword("hunter2") || !meta.SamePassword(checked) {
+		t.Errorf("password lost when replacing the content")
+	}
+}
+
+func TestResumableUploadOptions(t *testing.T) {
+	pileConfig := storage.PileConfig{
+		Lifetime:    storage.Lifetime{Duration: time.Hour},
+		MaxLifetime: storage.Lifetime{Duration: 2 * time.Hour},
+	}
+	eh, _ := openTestDatabase(t, onePile(pileConfig))
+	// Uploads in progress are kept in the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %s", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("chdir: %s", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if _, err := eh.CreateUpload("pile", storage.UploadInfo{Filename: "forever.txt", Lifetime: 3 * time.Hour}, 4); !errors.As(err, &storage.ErrUnacceptableLifetime{}) {
+		t.Errorf("expected ErrUnacceptableLifetime beyond the max, got %v", err)
+	}
+
+	info := storage.UploadInfo{Filename: "secret.txt", Password: "hunter2", Downloads: 1, Lifetime: 90 * time.Minute}
+	upload, err := eh.CreateUpload("pile", info, 4)
+	if err != nil {
+		t.Fatalf("create upload: %s", err)
+	}
+	if upload.PasswordHash == nil {
+		t.Errorf("password not hashed when the upload was created")
+	}
+	upload, err = eh.WriteUpload("pile", upload.ID, 0, strings.NewReader("shh!"))
+	if err != nil || !upload.IsComplete() {
+		t.Fatalf("write upload: complete %t, %v", upload.IsComplete(), err)
+	}
+
+	meta, content, err := readEntry(t, eh, "pile", upload.Entry)
+	if err != nil || content != "shh!" {
+		t.Fatalf("get got %q, %v", content, err)
+	}
+	if !meta.CheckPassword("hunter2") {
+		t.Errorf("password lost on the way")
+	}
+	if expires := meta.Expires(pileConfig.Lifetime.Duration); expires.Sub(meta.Time()) != 90*time.Minute {
+		t.Errorf("expires %s after creation, expected 1h30m", expires.Sub(meta.Time()))
+	}
+	if _, _, err := readEntry(t, eh, "pile", upload.Entry); !errors.As(err, &storage.ErrEntryGone{}) {
+		t.Errorf("expected ErrEntryGone after the only download, got %v", err)
+	}
+}
+
+func TestDownloadLimitedEntry(t *testing.T) {
+	config := storage.Config{Piles: map[string]storage.PileConfig{"pile": {}}}
+	eh, blobs := openTestDatabase(t, config)
+
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "secret.txt", Downloads: 2}, writeString("read me twice"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+
+	// Just looking doesn't count as a download.
+	err = eh.GetEntry("pile", entry, func(meta storage.EntryMeta, MIMEType string, file io.ReadSeeker) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("get without reading: %s", err)
+	}
+
+	var meta storage.EntryMeta
+	for i := range 2 {
+		var content string
+		meta, content, err = readEntry(t, eh, "pile", entry)
+		if err != nil || content != "read me twice" {
+			t.Fatalf("download %d got %q, %v", i+1, content, err)
+		}
+	}
+	gone := storage.ErrEntryGone{}
+	if _, _, err := readEntry(t, eh, "pile", entry); !errors.As(err, &gone) || gone.Reason != storage.TOMBSTONE_DOWNLOADED {
+		t.Errorf("expected ErrEntryGone after the last download, got %v", err)
+	}
+	// There's nothing left to delete, so it's like deleting twice.
+	if err := eh.DeleteEntry("pile", entry); !errors.As(err, &storage.ErrNoSuchEntry{}) {
+		t.Errorf("expected ErrNoSuchEntry deleting a downloaded entry, got %v", err)
+	}
+	if err := eh.StatEntry("pile", entry, func(storage.EntryMeta, string, int64) error { return nil }); !errors.As(err, &storage.ErrEntryGone{}) {
+		t.Errorf("expected ErrEntryGone from stat, got %v", err)
+	}
+	if _, err := blobs.Size(meta.Blob()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("blob still around after the last download (err: %v)", err)
+	}
+}
+
+func TestEntryLifetime(t *testing.T) {
+	pileConfig := storage.PileConfig{
+		Lifetime:    storage.Lifetime{Duration: time.Hour},
+		MaxLifetime: storage.Lifetime{Duration: 2 * time.Hour},
+	}
+	config := onePile(pileConfig)
+	eh, blobs := openTestDatabase(t, config)
+
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "forever.txt", Lifetime: 3 * time.Hour}, writeString("too long")); !errors.As(err, &storage.ErrUnacceptableLifetime{}) {
+		t.Errorf("expected ErrUnacceptableLifetime beyond the max, got %v", err)
+	}
+	longer, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "longer.txt", Lifetime: 90 * time.Minute}, writeString("longer"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	meta, _, _ := readEntry(t, eh, "pile", longer)
+	if expires := meta.Expires(pileConfig.Lifetime.Duration); expires.Sub(meta.Time()) != 90*time.Minute {
+		t.Errorf("expires %s after creation, expected 1h30m", expires.Sub(meta.Time()))
+	}
+
+	fleeting, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "fleeting.txt", Lifetime: time.Nanosecond}, writeString("gone soon"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	storage.VoidExpired(config, eh.DB(), blobs)
+	if _, _, err := readEntry(t, eh, "pile", fleeting); !errors.As(err, &storage.ErrEntryGone{}) {
+		t.Errorf("expected short lived entry to be expired, got %v", err)
+	}
+	if _, _, err := readEntry(t, eh, "pile", longer); err != nil {
+		t.Errorf("long lived entry expired early: %s", err)
+	}
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	lifetime := time.Hour
+	pileConfig := storage.PileConfig{Lifetime: storage.Lifetime{Duration: lifetime}, SlidingExpiry: true}
+	config := onePile(pileConfig)
+	eh, blobs := openTestDatabase(t, config)
+
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "popular.txt"}, writeString("in demand"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	stat := func() storage.EntryMeta {
+		t.Helper()
+		var meta storage.EntryMeta
+		err := eh.StatEntry("pile", entry, func(metaData storage.EntryMeta, MIMEType string, size int64) error {
+			meta = metaData
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("stat: %s", err)
+		}
+		return meta
+	}
+	uploaded := stat()
+	if !uploaded.Expires(lifetime).Equal(uploaded.Time().Add(lifetime)) {
+		t.Errorf("expires %s, before any download", uploaded.Expires(lifetime))
+	}
+
+	// Turned away, or already had it, so it's not a download.
+	err = eh.GetEntry("pile", entry, func(meta storage.EntryMeta, MIMEType string, file io.ReadSeeker) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("get without reading: %s", err)
+	}
+	if err := eh.FlushAccess(); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+	if !stat().LastAccess().IsZero() {
+		t.Errorf("last access noted without reading anything")
+	}
+
+	downloaded := time.Now()
+	if _, _, err := readEntry(t, eh, "pile", entry); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if err := eh.FlushAccess(); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+	storage.VoidExpired(config, eh.DB(), blobs)
+	meta := stat()
+	if meta.LastAccess().Before(downloaded) {
+		t.Fatalf("last access %s, but downloaded at %s", meta.LastAccess(), downloaded)
+	}
+	if expires := meta.Expires(lifetime); !expires.Equal(meta.LastAccess().Add(lifetime)) {
+		t.Errorf("expires %s, a lifetime after the download would be %s", expires, meta.LastAccess().Add(lifetime))
+	}
+	if !meta.IsExpired(lifetime, meta.LastAccess().Add(lifetime+time.Second)) {
+		t.Errorf("expected entry to expire once left alone for a lifetime")
+	}
+}
+
+func TestVoidExpiredInBatches(t *testing.T) {
+	pileConfig := storage.PileConfig{Lifetime: storage.Lifetime{Duration: time.Hour}}
+	config := onePile(pileConfig)
+	eh, blobs := openTestDatabase(t, config)
+
+	fleeting := storage.EXPIRE_BATCH_SIZE + 10
+	for i := range fleeting {
+		if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "fleeting.txt", Lifetime: time.Nanosecond}, writeString(fmt.Sprint(i))); err != nil {
+			t.Fatalf("create: %s", err)
+		}
+	}
+	lasting, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "lasting.txt"}, writeString("lasting"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	meta, _, _ := readEntry(t, eh, "pile", lasting)
+
+	time.Sleep(10 * time.Millisecond)
+	next := storage.VoidExpired(config, eh.DB(), blobs)
+	if !next.Equal(meta.Time().Add(time.Hour)) {
+		t.Errorf("next expiry is %s, expected %s", next, meta.Time().Add(time.Hour))
+	}
+	entries, err := eh.GetPileEntries("pile")
+	if err != nil {
+		t.Fatalf("listing: %s", err)
+	}
+	if _, ok := entries[lasting]; len(entries) != 1 || !ok {
+		t.Errorf("expected only the lasting entry to be left, got %d entries", len(entries))
+	}
+}
+
+func TestTombstonesArePruned(t *testing.T) {
+	config := storage.Config{
+		Piles:      map[string]storage.PileConfig{"pile": {}},
+		Tombstones: storage.Lifetime{Duration: time.Nanosecond},
+	}
+	eh, blobs := openTestDatabase(t, config)
+
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "short.txt"}, writeString("short lived"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := eh.DeleteEntry("pile", entry); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, _, err := readEntry(t, eh, "pile", entry); !errors.As(err, &storage.ErrEntryGone{}) {
+		t.Errorf("expected ErrEntryGone after delete, got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if next := storage.VoidExpired(config, eh.DB(), blobs); !next.IsZero() {
+		t.Errorf("expected nothing left to expire, but next is %s", next)
+	}
+	if _, _, err := readEntry(t, eh, "pile", entry); !errors.As(err, &storage.ErrNoSuchEntry{}) {
+		t.Errorf("expected ErrNoSuchEntry once the tombstone is pruned, got %v", err)
+	}
+}
+
+func TestPileCapacity(t *testing.T) {
+	eh, _ := openTestDatabase(t, onePile(storage.PileConfig{MaxEntries: 2, MaxTotalBytes: 10}))
+	first, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "a"}, writeString("aaaa"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "b"}, writeString("bbbbbbb")); !errors.As(err, &storage.ErrPileFull{}) {
+		t.Errorf("expected ErrPileFull going over max_total_bytes, got %v", err)
+	}
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "b"}, writeString("bbbb")); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "c"}, writeString("c")); !errors.As(err, &storage.ErrPileFull{}) {
+		t.Errorf("expected ErrPileFull going over max_entries, got %v", err)
+	}
+
+	// Known not to fit, so it's not even read.
+	unread := func(id string, dst io.Writer) error {
+		t.Errorf("read an upload that was never going to fit")
+		return nil
+	}
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "d", Length: 11}, unread); !errors.As(err, &storage.ErrPileFull{}) {
+		t.Errorf("expected ErrPileFull for a length going over max_total_bytes, got %v", err)
+	}
+	if err := eh.ReplaceEntry("pile", first, storage.UploadInfo{Filename: "a", Length: 7}, unread); !errors.As(err, &storage.ErrPileFull{}) {
+		t.Errorf("expected ErrPileFull for a replacement going over max_total_bytes, got %v", err)
+	}
+}
+
+func TestPileCapacityEviction(t *testing.T) {
+	eh, _ := openTestDatabase(t, onePile(storage.PileConfig{MaxEntries: 2, MaxTotalBytes: 10, WhenFull: storage.WHEN_FULL_EVICT}))
+	create := func(content string) string {
+		t.Helper()
+		entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: content}, writeString(content))
+		if err != nil {
+			t.Fatalf("create: %s", err)
+		}
+		return entry
+	}
+	// All in the same second, most likely, which shouldn't get the order mixed up.
+	first := create("1111")
+	second := create("2222")
+	third := create("333")
+
+	gone := storage.ErrEntryGone{}
+	if _, _, err := readEntry(t, eh, "pile", first); !errors.As(err, &gone) || gone.Reason != storage.TOMBSTONE_EVICTED {
+		t.Errorf("expected the first entry to be evicted, got %v", err)
+	}
+	if _, content, err := readEntry(t, eh, "pile", second); err != nil || content != "2222" {
+		t.Errorf("expected the second entry to stay, got %q, %v", content, err)
+	}
+
+	newest := create("44444444")
+	if _, _, err := readEntry(t, eh, "pile", second); !errors.As(err, &gone) {
+		t.Errorf("expected the second entry to be evicted, got %v", err)
+	}
+	if _, _, err := readEntry(t, eh, "pile", third); !errors.As(err, &gone) {
+		t.Errorf("expected the third entry to be evicted to fit the bytes, got %v", err)
+	}
+	if _, content, err := readEntry(t, eh, "pile", newest); err != nil || content != "44444444" {
+		t.Errorf("newest entry got %q, %v", content, err)
+	}
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "huge"}, writeString("way too big to ever fit")); !errors.As(err, &storage.ErrPileFull{}) {
+		t.Errorf("expected ErrPileFull for something bigger than the pile, got %v", err)
+	}
+}
+
+func TestLegacyEntriesCountTowardsCapacity(t *testing.T) {
+	config := onePile(storage.PileConfig{MaxTotalBytes: 10})
+	eh, blobs := openTestDatabase(t, config)
+	putLegacyEntry(t, eh, blobs, config, "old.txt", time.Now(), "8 bytes!")
+
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "new.txt"}, writeString("four")); !errors.As(err, &storage.ErrPileFull{}) {
+		t.Errorf("expected ErrPileFull with the legacy entry counted by its blob, got %v", err)
+	}
+	// Taken back off by the same size it was counted with.
+	if err := eh.DeleteEntry("pile", "old.txt"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "new.txt"}, writeString("ten bytes!")); err != nil {
+		t.Errorf("expected the whole pile free once the legacy entry is gone, got %v", err)
+	}
+}
+
+func TestDiskHighWatermark(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("disk usage is only known on linux")
+	}
+	config := storage.Config{
+		Piles: map[string]storage.PileConfig{"pile": {}},
+		Disk:  storage.DiskConfig{HighWatermark: 0.0001},
+	}
+	eh, _ := openTestDatabase(t, config)
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "full.txt"}, writeString("no room")); !errors.As(err, &storage.ErrDiskFull{}) {
+		t.Errorf("expected ErrDiskFull above the high watermark, got %v", err)
+	}
+	if _, err := eh.SpoolEntry("pile"); !errors.As(err, &storage.ErrDiskFull{}) {
+		t.Errorf("expected ErrDiskFull spooling above the high watermark, got %v", err)
+	}
+}
+
+func TestSpoolEntry(t *testing.T) {
+	config := onePile(storage.PileConfig{})
+	root := t.TempDir()
+	eh, err := storage.OpenBoltDatabase(filepath.Join(t.TempDir(), "boltpile.db"), config, storage.NewFilesystemStore(root))
+	if err != nil {
+		t.Fatalf("opening database: %s", err)
+	}
+	t.Cleanup(func() { eh.Close() })
+
+	spool, err := eh.SpoolEntry("pile")
+	if err != nil {
+		t.Fatalf("spool: %s", err)
+	}
+	if _, err := io.WriteString(spool, "kept aside"); err != nil {
+		t.Fatalf("write spool: %s", err)
+	}
+	// Where the blob store stages its own writes, so startup knows to sweep it up.
+	spooled, _ := filepath.Glob(filepath.Join(root, storage.TEMP_PREFIX+"*"))
+	if len(spooled) != 1 {
+		t.Errorf("expected the spool in the blob store root, found %v", spooled)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek spool: %s", err)
+	}
+	if content, err := io.ReadAll(spool); err != nil || string(content) != "kept aside" {
+		t.Errorf("spool read back %q, %v", content, err)
+	}
+	spool.Close()
+	if spooled, _ := filepath.Glob(filepath.Join(root, storage.TEMP_PREFIX+"*")); len(spooled) != 0 {
+		t.Errorf("expected the spool gone once closed, found %v", spooled)
+	}
+	if _, err := eh.SpoolEntry("nope"); !errors.As(err, &storage.ErrNoSuchPile{}) {
+		t.Errorf("expected ErrNoSuchPile spooling for an unknown pile, got %v", err)
+	}
+}
+
+func TestVoidSoonest(t *testing.T) {
+	pileConfig := storage.PileConfig{Lifetime: storage.Lifetime{Duration: time.Hour}, MaxLifetime: storage.Lifetime{Duration: 4 * time.Hour}}
+	config := onePile(pileConfig)
+	eh, blobs := openTestDatabase(t, config)
+
+	entries := []string{}
+	for _, lifetime := range []time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour} {
+		entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: lifetime.String(), Lifetime: lifetime}, writeString(lifetime.String()))
+		if err != nil {
+			t.Fatalf("create: %s", err)
+		}
+		entries = append(entries, entry)
+	}
+	if culled := storage.VoidSoonest(config, eh.DB(), blobs, 2); culled != 2 {
+		t.Errorf("culled %d entries, expected 2", culled)
+	}
+	gone := storage.ErrEntryGone{}
+	for _, entry := range entries[1:] {
+		if _, _, err := readEntry(t, eh, "pile", entry); !errors.As(err, &gone) || gone.Reason != storage.TOMBSTONE_CULLED {
+			t.Errorf("expected %s to be culled, got %v", entry, err)
+		}
+	}
+	if _, content, err := readEntry(t, eh, "pile", entries[0]); err != nil || content != "3h0m0s" {
+		t.Errorf("latest to expire got %q, %v", content, err)
+	}
+	if culled := storage.VoidSoonest(config, eh.DB(), blobs, 2); culled != 1 {
+		t.Errorf("culled %d entries, expected the last one", culled)
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	eh, _ := openTestDatabase(t, onePile(storage.PileConfig{TrashGrace: storage.Lifetime{Duration: time.Hour}}))
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "oops.txt"}, writeString("not done with this"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := eh.DeleteEntry("pile", entry); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, _, err := readEntry(t, eh, "pile", entry); !errors.As(err, &storage.ErrEntryGone{}) {
+		t.Errorf("expected deleted entry to be gone, got %v", err)
+	}
+	trash, err := eh.GetTrash("pile")
+	if err != nil {
+		t.Fatalf("get trash: %s", err)
+	}
+	if trashed, ok := trash[entry]; !ok || trashed.Reason != storage.TOMBSTONE_DELETED || trashed.Meta.Filename() != "oops.txt" {
+		t.Errorf("expected the entry in the trash, got %+v", trash)
+	}
+
+	if err := eh.RestoreEntry("pile", entry); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if _, content, err := readEntry(t, eh, "pile", entry); err != nil || content != "not done with this" {
+		t.Errorf("restored entry got %q, %v", content, err)
+	}
+	if err := eh.RestoreEntry("pile", entry); !errors.As(err, &storage.ErrNotInTrash{}) {
+		t.Errorf("expected ErrNotInTrash restoring twice, got %v", err)
+	}
+}
+
+func TestRestoreExpiredLegacyEntry(t *testing.T) {
+	config := onePile(storage.PileConfig{Lifetime: storage.Lifetime{Duration: time.Hour}, TrashGrace: storage.Lifetime{Duration: time.Hour}})
+	eh, blobs := openTestDatabase(t, config)
+	putLegacyEntry(t, eh, blobs, config, "old.txt", time.Now().Add(-90*time.Minute), "from way back")
+
+	storage.VoidExpired(config, eh.DB(), blobs)
+	if _, _, err := readEntry(t, eh, "pile", "old.txt"); !errors.As(err, &storage.ErrEntryGone{}) {
+		t.Fatalf("expected the legacy entry to expire, got %v", err)
+	}
+	if err := eh.RestoreEntry("pile", "old.txt"); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	// It gets the lifetime it had all over again, and the next pass mustn't take it back.
+	storage.VoidExpired(config, eh.DB(), blobs)
+	if _, content, err := readEntry(t, eh, "pile", "old.txt"); err != nil || content != "from way back" {
+		t.Errorf("restored legacy entry got %q, %v", content, err)
+	}
+}
+
+func TestEvictedEntriesSkipTheTrash(t *testing.T) {
+	eh, blobs := openTestDatabase(t, onePile(storage.PileConfig{MaxEntries: 1, WhenFull: storage.WHEN_FULL_EVICT, TrashGrace: storage.Lifetime{Duration: time.Hour}}))
+	evicted, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "old.txt"}, writeString("old news"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	meta, _, _ := readEntry(t, eh, "pile", evicted)
+	if _, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "new.txt"}, writeString("hot off the press")); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	trash, err := eh.GetTrash("pile")
+	if err != nil {
+		t.Fatalf("get trash: %s", err)
+	}
+	if len(trash) != 0 {
+		t.Errorf("expected nothing in the trash after eviction, got %+v", trash)
+	}
+	if _, err := blobs.Size(meta.Blob()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("evicted content still takes up space (err: %v)", err)
+	}
+}
+
+func TestTrashIsPurged(t *testing.T) {
+	pileConfig := storage.PileConfig{TrashGrace: storage.Lifetime{Duration: time.Nanosecond}}
+	config := onePile(pileConfig)
+	eh, blobs := openTestDatabase(t, config)
+
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "done.txt"}, writeString("done with this"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := eh.DeleteEntry("pile", entry); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	storage.VoidExpired(config, eh.DB(), blobs)
+	if trash, _ := eh.GetTrash("pile"); len(trash) != 0 {
+		t.Errorf("expected the trash to be purged, got %+v", trash)
+	}
+	if err := eh.RestoreEntry("pile", entry); !errors.As(err, &storage.ErrNotInTrash{}) {
+		t.Errorf("expected ErrNotInTrash after purging, got %v", err)
+	}
+}
+
+func TestLegalHold(t *testing.T) {
+	pileConfig := storage.PileConfig{Lifetime: storage.Lifetime{Duration: time.Hour}}
+	config := onePile(pileConfig)
+	eh, blobs := openTestDatabase(t, config)
+
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "evidence.txt", Lifetime: time.Nanosecond}, writeString("exhibit A"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := eh.HoldEntry("pile", entry); err != nil {
+		t.Fatalf("hold: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	storage.VoidExpired(config, eh.DB(), blobs)
+	meta, content, err := readEntry(t, eh, "pile", entry)
+	if err != nil || content != "exhibit A" || !meta.IsHeld() {
+		t.Errorf("held entry got %q, %v", content, err)
+	}
+	if err := eh.DeleteEntry("pile", entry); !errors.As(err, &storage.ErrEntryHeld{}) {
+		t.Errorf("expected ErrEntryHeld deleting a held entry, got %v", err)
+	}
+	if err := eh.ReplaceEntry("pile", entry, storage.UploadInfo{Filename: "evidence.txt"}, writeString("nothing to see")); !errors.As(err, &storage.ErrEntryHeld{}) {
+		t.Errorf("expected ErrEntryHeld replacing a held entry, got %v", err)
+	}
+
+	if err := eh.ReleaseEntry("pile", entry); err != nil {
+		t.Fatalf("release: %s", err)
+	}
+	storage.VoidExpired(config, eh.DB(), blobs)
+	gone := storage.ErrEntryGone{}
+	if _, _, err := readEntry(t, eh, "pile", entry); !errors.As(err, &gone) || gone.Reason != storage.TOMBSTONE_EXPIRED {
+		t.Errorf("expected released entry to expire, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// What a pile does when an upload would take it over max_entries or max_total_bytes.
+const (
+	WHEN_FULL_REJECT = "reject"
+	WHEN_FULL_EVICT  = "evict"
+
+	TOMBSTONE_EVICTED = "evicted"
+)
+
+// The usage bucket has the number of entries and total size of each pile, so
+// checking capacity doesn't mean adding it all up. The ages bucket lists the
+// entries of each pile oldest first, for eviction.
+
+type pileUsage struct {
+	entries int64
+	bytes   int64
+}
+
+func getUsage(tx *bbolt.Tx, pile string) pileUsage {
+	value := tx.Bucket(usageBucket).Get([]byte(pile))
+	if len(value) != 16 {
+		return pileUsage{}
+	}
+	return pileUsage{
+		entries: int64(binary.LittleEndian.Uint64(value)),
+		bytes:   int64(binary.LittleEndian.Uint64(value[8:])),
+	}
+}
+
+func addUsage(tx *bbolt.Tx, pile string, entries int64, bytes int64) error {
+	usage := getUsage(tx, pile)
+	value := binary.LittleEndian.AppendUint64(nil, uint64(max(usage.entries+entries, 0)))
+	value = binary.LittleEndian.AppendUint64(value, uint64(max(usage.bytes+bytes, 0)))
+	return tx.Bucket(usageBucket).Put([]byte(pile), value)
+}
+
+// ageKey sorts the entries of a pile by when they were uploaded. Upload times are
+// to the second, so the sequence of the upload sorts those in the same one.
+func ageKey(pile string, entry string, entryMeta EntryMeta) []byte {
+	key := append([]byte(pile), 0)
+	key = binary.BigEndian.AppendUint64(key, uint64(entryMeta.Time().Unix()))
+	key = binary.BigEndian.AppendUint64(key, entryMeta.sequence)
+	return append(key, entry...)
+}
+
+// countEntry and uncountEntry keep the usage and ages buckets up to date.
+func countEntry(tx *bbolt.Tx, pile string, entry string, entryMeta EntryMeta) error {
+	if err := addUsage(tx, pile, 1, entryMeta.Size()); err != nil {
+		return err
+	}
+	return tx.Bucket(agesBucket).Put(ageKey(pile, entry, entryMeta), nil)
+}
+
+func uncountEntry(tx *bbolt.Tx, pile string, entry string, entryMeta EntryMeta) error {
+	if err := addUsage(tx, pile, -1, -entryMeta.Size()); err != nil {
+		return err
+	}
+	return tx.Bucket(agesBucket).Delete(ageKey(pile, entry, entryMeta))
+}
+
+// oldestEntry is the entry of a pile that was uploaded first, and its key in the
+// ages bucket, except for the one being made room for and those on hold. Nothing
+// else, and it's empty.
+func oldestEntry(tx *bbolt.Tx, pile string, except string) (string, []byte) {
+	prefix := append([]byte(pile), 0)
+	cursor := tx.Bucket(agesBucket).Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && len(k) >= len(prefix)+16; k, _ = cursor.Next() {
+		entry := string(k[len(prefix)+16:])
+		if entry == except {
+			continue
+		}
+		if entryMeta, err := getEntryMeta(tx, pile, entry); err == nil && entryMeta.IsHeld() {
+			continue
+		}
+		return entry, append([]byte{}, k...)
+	}
+	return "", nil
+}
+
+// fits is whether an entry of the given size fits in the pile as it is, replacing
+// what's there under the same name, if anything.
+func fits(tx *bbolt.Tx, pileConfig PileConfig, pile string, entry string, size int64) bool {
+	entries, growth := int64(1), size
+	if previous, err := getEntryMeta(tx, pile, entry); err == nil {
+		entries, growth = 0, size-previous.Size()
+	}
+	usage := getUsage(tx, pile)
+	tooMany := pileConfig.MaxEntries > 0 && usage.entries+entries > int64(pileConfig.MaxEntries)
+	tooBig := pileConfig.MaxTotalBytes > 0 && usage.bytes+growth > pileConfig.MaxTotalBytes
+	return !tooMany && !tooBig
+}
+
+// checkRoom is ErrPileFull if an upload of the given size is never going to fit,
+// so it can be turned away before it's taken. Piles that evict can still make room.
+func checkRoom(tx *bbolt.Tx, pileConfig PileConfig, pile string, entry string, size int64) error {
+	if pileConfig.MaxTotalBytes > 0 && size > pileConfig.MaxTotalBytes {
+		return ErrPileFull{Pile: pile}
+	}
+	if pileConfig.WhenFull != WHEN_FULL_EVICT && !fits(tx, pileConfig, pile, entry, size) {
+		return ErrPileFull{Pile: pile}
+	}
+	return nil
+}
+
+// makeRoom checks that an entry of the given size fits in the pile, replacing what's
+// there under the same name, if anything. In piles that evict, the oldest entries
+// go until it does.
+func (eh BoltDatabase) makeRoom(tx *bbolt.Tx, pileConfig PileConfig, pile string, entry string, size int64) error {
+	if pileConfig.MaxEntries <= 0 && pileConfig.MaxTotalBytes <= 0 {
+		return nil
+	}
+	if err := checkRoom(tx, pileConfig, pile, entry, size); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for !fits(tx, pileConfig, pile, entry, size) {
+		oldest, key := oldestEntry(tx, pile, entry)
+		if oldest == "" {
+			return ErrPileFull{Pile: pile}
+		}
+		entryMeta, err := getEntryMeta(tx, pile, oldest)
+		if err != nil {
+			// Can't be evicted, so it shouldn't be in the way either.
+			log.Warn().Err(err).Str("operation", "evict").Str("pile", pile).Str("entry", oldest).Msg("Dropping unknown entry from the ages")
+			if err := tx.Bucket(agesBucket).Delete(key); err != nil {
+				return ErrFailedDeletingEntryMetadata{Pile: pile, Entry: oldest, UpstreamError: err}
+			}
+			continue
+		}
+		if err := eh.evict(tx, pile, oldest, entryMeta, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict lets go of an entry for good, to make room. Evicted entries skip the trash,
+// as the trash isn't counted against the pile, and the room would only be taken up
+// somewhere else.
+func (eh BoltDatabase) evict(tx *bbolt.Tx, pile string, entry string, entryMeta EntryMeta, now time.Time) error {
+	log.Info().Str("operation", "evict").Str("pile", pile).Str("entry", entry).Msg("Evicted!")
+	prune, err := bury(tx, eh.config, pile, entry, entryMeta, TOMBSTONE_EVICTED, now)
+	if err != nil {
+		return ErrFailedDeletingEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	eh.alarm.consider(prune)
+	if entryMeta.IsExhausted() {
+		return nil
+	}
+	if err := releaseBlob(tx, eh.blobs, blobKey(pile, entry, entryMeta)); err != nil {
+		return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs a pile can compress its entries with. The names double as the
+// Content-Encoding used when handing the compressed bytes straight to a client.
+const (
+	CODEC_GZIP = "gzip"
+	CODEC_ZSTD = "zstd"
+)
+
+func validCodec(codec string) bool {
+	switch codec {
+	case "", CODEC_GZIP, CODEC_ZSTD:
+		return true
+	}
+	return false
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// newEncoder compresses into dst. Closing it flushes, but leaves dst open.
+func newEncoder(codec string, dst io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case "":
+		return nopWriteCloser{dst}, nil
+	case CODEC_GZIP:
+		return gzip.NewWriter(dst), nil
+	case CODEC_ZSTD:
+		return zstd.NewWriter(dst)
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+func newDecoder(codec string, src io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CODEC_GZIP:
+		return gzip.NewReader(src)
+	case CODEC_ZSTD:
+		decoder, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+// CompressedContent is what GetEntry hands over for entries that are compressed at
+// rest. Reading it gives the original content, but if the client can take it,
+// Compressed gives the bytes as they are stored, to save everyone the trouble.
+type CompressedContent interface {
+	io.ReadSeeker
+	Codec() string
+	Compressed() (io.ReadSeeker, error)
+}
+
+// decodingReader decompresses a blob as it's read. Compressed streams can't be
+// seeked in, so it pretends: seeking ahead skips content, and seeking back starts
+// over from the top. That is plenty for ranged requests resuming a download.
+type decodingReader struct {
+	blob     Blob
+	codec    string
+	size     int64
+	position int64
+	decoded  int64
+	decoder  io.ReadCloser
+}
+
+func newDecodingReader(blob Blob, codec string, size int64) *decodingReader {
+	return &decodingReader{blob: blob, codec: codec, size: size}
+}
+
+func (dr *decodingReader) Read(p []byte) (int, error) {
+	if dr.position >= dr.size {
+		return 0, io.EOF
+	}
+	if dr.decoder == nil || dr.decoded > dr.position {
+		if err := dr.restart(); err != nil {
+			return 0, err
+		}
+	}
+	if dr.decoded < dr.position {
+		skipped, err := io.CopyN(io.Discard, dr.decoder, dr.position-dr.decoded)
+		dr.decoded += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := dr.decoder.Read(p)
+	dr.position += int64(n)
+	dr.decoded += int64(n)
+	return n, err
+}
+
+func (dr *decodingReader) restart() error {
+	if dr.decoder != nil {
+		dr.decoder.Close()
+		dr.decoder = nil
+	}
+	if _, err := dr.blob.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	decoder, err := newDecoder(dr.codec, dr.blob)
+	if err != nil {
+		return err
+	}
+	dr.decoder = decoder
+	dr.decoded = 0
+	return nil
+}
+
+func (dr *decodingReader) Seek(offset int64, whence int) (int64, error) {
+	position := dr.position
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position += offset
+	case io.SeekEnd:
+		position = dr.size + offset
+	}
+	if position < 0 {
+		return dr.position, errors.New("seek to before the start of the content")
+	}
+	dr.position = position
+	return position, nil
+}
+
+func (dr *decodingReader) Codec() string {
+	return dr.codec
+}
+
+func (dr *decodingReader) Compressed() (io.ReadSeeker, error) {
+	if dr.decoder != nil {
+		dr.decoder.Close()
+		dr.decoder = nil
+	}
+	if _, err := dr.blob.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return dr.blob, nil
+}
+
+func (dr *decodingReader) Close() error {
+	if dr.decoder != nil {
+		return dr.decoder.Close()
+	}
+	return nil
+}
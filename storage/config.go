@@ -41,15 +41,106 @@ func (lt *Lifetime) UnmarshalJSON(b []byte) error {
 type Config struct {
 	Piles         map[string]PileConfig `json:"piles"`
 	ForwardHeader string                `json:"forward_header"`
+	Storage       StorageConfig         `json:"storage"`
+
+	AdminKey   string     `json:"admin_key"`           // For the trash of any pile.
+	Tombstones Lifetime   `json:"tombstone_retention"` // How long to remember entries that are gone.
+	Disk       DiskConfig `json:"disk"`
+}
+
+// DiskConfig is about the filesystem the database and piles are on. The watermarks
+// are how much of it is in use, in percent.
+type DiskConfig struct {
+	HighWatermark    float64 `json:"high_watermark"`    // Uploads are refused above this.
+	LowWatermark     float64 `json:"low_watermark"`     // What aggressive expiry brings it back down to.
+	AggressiveExpiry bool    `json:"aggressive_expiry"` // Void whatever expires soonest when above the high watermark.
+}
+
+type StorageConfig struct {
+	Backend   string `json:"backend"`
+	Directory string `json:"directory"`
+
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
 }
 
 type PileConfig struct {
-	Lifetime Lifetime `json:"lifetime"`
-	Origin   string   `json:"origin"`
-	POSTKey  string   `json:"post_key"`
-	GETKey   string   `json:"get_key"`
-	ListKey  string   `json:"list_key"`
-	MaxSize  int64    `json:"max_size"`
+	Lifetime    Lifetime `json:"lifetime"`
+	MaxLifetime Lifetime `json:"max_lifetime"`
+	Origin      string   `json:"origin"`
+	POSTKey     string   `json:"post_key"`
+	GETKey      string   `json:"get_key"`
+	ListKey     string   `json:"list_key"`
+	PUTKey      string   `json:"put_key"`
+	DELETEKey   string   `json:"delete_key"`
+	MaxSize     int64    `json:"max_size"`
+
+	MaxEntries    int    `json:"max_entries"`
+	MaxTotalBytes int64  `json:"max_total_bytes"`
+	WhenFull      string `json:"when_full"`
+
+	UseFilename bool   `json:"use_filename"`
+	Collision   string `json:"collision"`
+	Compression string `json:"compression"`
+
+	SlidingExpiry bool     `json:"sliding_expiry"` // Lifetime counts from the last download.
+	TrashGrace    Lifetime `json:"trash_grace"`    // How long expired and deleted entries can be restored, outside of the capacity.
+
+	EncryptionKeys    []string `json:"encryption_keys"`
+	EncryptionKeyFile string   `json:"encryption_key_file"`
+}
+
+func (c Config) TombstoneRetention() time.Duration {
+	if c.Tombstones.Duration <= 0 {
+		return TOMBSTONE_RETENTION_DEFAULT
+	}
+	return c.Tombstones.Duration
+}
+
+// DataDirectory is where to check for free space. The piles are there, unless
+// they're somewhere else entirely, and so is the database.
+func (c Config) DataDirectory() string {
+	switch c.Storage.Backend {
+	case "", BACKEND_FILESYSTEM:
+		if c.Storage.Directory != "" {
+			return c.Storage.Directory
+		}
+	}
+	return "."
+}
+
+// CullsDisk is whether aggressive expiry is on, and frees up space where it's
+// measured. Blobs kept anywhere else take up none of it, so culling them would
+// only throw entries away for nothing.
+func (c Config) CullsDisk() bool {
+	switch c.Storage.Backend {
+	case "", BACKEND_FILESYSTEM:
+		return c.Disk.AggressiveExpiry
+	}
+	return false
+}
+
+// CullTarget is how full aggressive expiry leaves the disk: the low watermark,
+// or the high one if that isn't set.
+func (dc DiskConfig) CullTarget() float64 {
+	if dc.LowWatermark <= 0 {
+		return dc.HighWatermark
+	}
+	return dc.LowWatermark
+}
+
+func (dc DiskConfig) Validate() error {
+	if dc.HighWatermark < 0 || dc.HighWatermark > 100 {
+		return fmt.Errorf("high watermark %g is not a percentage", dc.HighWatermark)
+	}
+	if dc.LowWatermark < 0 || dc.LowWatermark > dc.HighWatermark {
+		return fmt.Errorf("low watermark %g is not between 0 and the high watermark", dc.LowWatermark)
+	}
+	return nil
 }
 
 func (c Config) BucketNames() [][]byte {
@@ -67,6 +158,39 @@ func (c Config) Pile(pile string) (PileConfig, error) {
 	return PileConfig{}, ErrNoSuchPile{pile}
 }
 
+func (pc PileConfig) IsEncrypted() bool {
+	return len(pc.EncryptionKeys) > 0 || pc.EncryptionKeyFile != ""
+}
+
+// AllowsLifetime says if an upload can ask for the given lifetime instead of the
+// pile lifetime. Shorter is always fine, but longer only up to MaxLifetime.
+func (pc PileConfig) AllowsLifetime(lifetime time.Duration) bool {
+	if lifetime <= 0 {
+		return false
+	}
+	if pc.Lifetime.Duration <= 0 || lifetime <= pc.Lifetime.Duration {
+		return true
+	}
+	return lifetime <= pc.MaxLifetime.Duration
+}
+
+func (pc PileConfig) Validate() error {
+	switch pc.Collision {
+	case "", COLLISION_REJECT, COLLISION_OVERWRITE, COLLISION_SUFFIX:
+	default:
+		return fmt.Errorf("unknown collision policy %q", pc.Collision)
+	}
+	switch pc.WhenFull {
+	case "", WHEN_FULL_REJECT, WHEN_FULL_EVICT:
+	default:
+		return fmt.Errorf("unknown when_full policy %q", pc.WhenFull)
+	}
+	if !validCodec(pc.Compression) {
+		return fmt.Errorf("unknown compression %q", pc.Compression)
+	}
+	return nil
+}
+
 func LoadConfig(filename string) Config {
 	log.Debug().Str("filename", filename).Msg("Loading config")
 	file, err := os.Open(filename)
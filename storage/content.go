@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"net/http"
+)
+
+// contentRecorder sits between CreateWithFunc and the file, taking note of
+// the size, MIME type and digest of whatever passes through. It also does the
+// compressing and encrypting, if any, so it has to be closed once everything
+// is written.
+type contentRecorder struct {
+	dst    io.WriteCloser
+	stored *countingWriter
+	sealer *sealingWriter
+	codec  string
+	hash   hash.Hash
+	size   int64
+	sniff  []byte
+}
+
+// newContentRecorder writes into dst, compressed with the codec and then sealed
+// with the key, unless those are empty.
+func newContentRecorder(dst io.Writer, codec string, key encryptionKey) (*contentRecorder, error) {
+	var sealer *sealingWriter
+	if !key.IsZero() {
+		var err error
+		if sealer, err = newSealingWriter(dst, key); err != nil {
+			return nil, err
+		}
+		dst = sealer
+	}
+	stored := &countingWriter{dst: dst}
+	encoder, err := newEncoder(codec, stored)
+	if err != nil {
+		return nil, err
+	}
+	return &contentRecorder{
+		dst:    encoder,
+		stored: stored,
+		sealer: sealer,
+		codec:  codec,
+		hash:   sha256.New(),
+		sniff:  make([]byte, 0, 512),
+	}, nil
+}
+
+func (cr *contentRecorder) Write(p []byte) (int, error) {
+	n, err := cr.dst.Write(p)
+	cr.hash.Write(p[:n])
+	cr.size += int64(n)
+	if room := cap(cr.sniff) - len(cr.sniff); room > 0 {
+		cr.sniff = append(cr.sniff, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+func (cr *contentRecorder) Close() error {
+	if err := cr.dst.Close(); err != nil {
+		return err
+	}
+	if cr.sealer != nil {
+		return cr.sealer.Close()
+	}
+	return nil
+}
+
+// Meta adds what was recorded to the given entry metadata. The MIME type is
+// only sniffed from the content if the uploader didn't say what it is.
+func (cr *contentRecorder) Meta(meta EntryMeta, contentType string) EntryMeta {
+	if contentType == "" {
+		contentType = http.DetectContentType(cr.sniff)
+	}
+	meta = meta.WithContent(cr.size, contentType, cr.hash.Sum(nil))
+	if cr.codec != "" {
+		meta = meta.WithEncoding(cr.codec, cr.stored.n)
+	}
+	if cr.sealer != nil {
+		meta = meta.WithEncryption(cr.sealer.key.id, cr.sealer.salt)
+	}
+	return meta
+}
+
+// countingWriter counts what actually goes into the blob, which is less than
+// what was uploaded when it's compressed.
+type countingWriter struct {
+	dst io.Writer
+	n   int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.dst.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// Once the disk gets too full, uploads are refused, rather than failing halfway
+// through. With aggressive expiry, whatever was going to expire soonest goes early
+// until there's room again.
+const (
+	DISK_CHECK_INTERVAL = 5 * time.Second // How long to trust what the filesystem last said.
+	DISK_CULL_BATCH     = 16              // Entries culled before checking again.
+	DISK_CULL_LIMIT     = 1024            // Most entries culled in one go, in case it isn't helping.
+
+	TOMBSTONE_CULLED = "culled"
+)
+
+type diskMonitor struct {
+	mu      sync.Mutex
+	path    string
+	checked time.Time
+	used    float64
+	err     error
+	culling atomic.Bool
+}
+
+func newDiskMonitor(path string) *diskMonitor {
+	return &diskMonitor{path: path}
+}
+
+// usage is how full the disk is, as of no longer than DISK_CHECK_INTERVAL ago.
+func (dm *diskMonitor) usage() (float64, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if time.Since(dm.checked) > DISK_CHECK_INTERVAL {
+		dm.used, dm.err = diskUsage(dm.path)
+		dm.checked = time.Now()
+	}
+	return dm.used, dm.err
+}
+
+// recheck forgets what the filesystem last said, for when it's known to have changed.
+func (dm *diskMonitor) recheck() (float64, error) {
+	dm.mu.Lock()
+	dm.checked = time.Time{}
+	dm.mu.Unlock()
+	return dm.usage()
+}
+
+// checkDisk is ErrDiskFull when the disk is above the high watermark. If we
+// can't tell, it's not going to get in the way.
+func (eh BoltDatabase) checkDisk(pile string) error {
+	high := eh.config.Disk.HighWatermark
+	if high <= 0 {
+		return nil
+	}
+	used, err := eh.disk.usage()
+	if err != nil || used < high {
+		return nil
+	}
+	if eh.config.CullsDisk() {
+		go eh.makeSpace()
+	}
+	return ErrDiskFull{Pile: pile, Used: used}
+}
+
+// makeSpace culls entries while the disk is above the high watermark, until it's
+// down to the low one, or DISK_CULL_LIMIT entries went without getting there. Only
+// one of these runs at a time.
+func (eh BoltDatabase) makeSpace() {
+	disk := eh.config.Disk
+	if !eh.config.CullsDisk() || disk.HighWatermark <= 0 {
+		return
+	}
+	if !eh.disk.culling.CompareAndSwap(false, true) {
+		return
+	}
+	defer eh.disk.culling.Store(false)
+
+	used, err := eh.disk.recheck()
+	if err != nil || used < disk.HighWatermark {
+		return
+	}
+	culled := 0
+	for used > disk.CullTarget() {
+		if culled >= DISK_CULL_LIMIT {
+			log.Warn().Str("operation", "cull").Int("culled", culled).Float64("used", used).Msg("Culled as much as is allowed in one go, and the disk is still too full")
+			break
+		}
+		count := VoidSoonest(eh.config, eh.db, eh.blobs, min(DISK_CULL_BATCH, DISK_CULL_LIMIT-culled))
+		if count == 0 {
+			log.Warn().Str("operation", "cull").Float64("used", used).Msg("Nothing left that expires, and the disk is still too full")
+			break
+		}
+		culled += count
+		if used, err = eh.disk.recheck(); err != nil {
+			break
+		}
+	}
+	log.Info().Str("operation", "cull").Int("culled", culled).Float64("used", used).Msg("Made space!")
+}
+
+// VoidSoonest voids up to limit entries, those that would expire soonest, whether
+// they're due or not, and purges the trash along the way. Entries that never expire
+// are left alone. It returns how many went.
+func VoidSoonest(config Config, db *bbolt.DB, blobs BlobStore, limit int) int {
+	type candidate struct {
+		pile  string
+		entry string
+		meta  EntryMeta
+		live  bool
+	}
+	culled := 0
+	err := db.Update(func(tx *bbolt.Tx) error {
+		soonest := []candidate{}
+		seen := map[string]bool{}
+		cursor := tx.Bucket(expiryBucket).Cursor()
+		for k, _ := cursor.First(); k != nil && len(soonest) < limit; k, _ = cursor.Next() {
+			_, pile, entry := parseExpiryKey(k)
+			if seen[accessKey(pile, entry)] {
+				continue
+			}
+			entryMeta, err := getEntryMeta(tx, pile, entry)
+			if _, trashed := getTrash(tx, pile, entry); err != nil && !trashed {
+				continue // Tombstones hardly take up any space.
+			}
+			seen[accessKey(pile, entry)] = true
+			soonest = append(soonest, candidate{pile: pile, entry: entry, meta: entryMeta, live: err == nil})
+		}
+		now := time.Now()
+		for _, c := range soonest {
+			purged, err := purgeTrash(tx, config, blobs, c.pile, c.entry, time.Time{})
+			if err != nil {
+				return err
+			}
+			if c.live {
+				log.Info().Str("operation", "cull").Str("pile", c.pile).Str("entry", c.entry).Msg("Culled!")
+				if err := voidEntry(tx, config, blobs, c.pile, c.entry, c.meta, TOMBSTONE_CULLED, now, false); err != nil {
+					return err
+				}
+			}
+			if purged || c.live {
+				culled++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Error during VoidSoonest operation")
+		return 0
+	}
+	return culled
+}
+
+// watchDisk says how full the disk is at startup, and if the watermarks can work.
+func (eh BoltDatabase) watchDisk() {
+	disk := eh.config.Disk
+	if disk.HighWatermark <= 0 {
+		return
+	}
+	used, err := eh.disk.recheck()
+	if err != nil {
+		log.Warn().Err(err).Str("directory", eh.disk.path).Msg("Can't tell how full the disk is, so the watermarks do nothing")
+		return
+	}
+	if disk.AggressiveExpiry && !eh.config.CullsDisk() {
+		log.Warn().Str("backend", eh.config.Storage.Backend).Msg("Aggressive expiry does nothing when the entries aren't on the disk being watched")
+	}
+	log.Info().
+		Str("directory", eh.disk.path).
+		Float64("used", used).
+		Float64("high watermark", disk.HighWatermark).
+		Float64("low watermark", disk.CullTarget()).
+		Bool("aggressive expiry", eh.config.CullsDisk()).
+		Msg("Watching disk space!")
+	if used >= disk.HighWatermark {
+		go eh.makeSpace()
+	}
+}
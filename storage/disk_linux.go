@@ -0,0 +1,18 @@
+//go:build linux
+
+package storage
+
+import "syscall"
+
+// diskUsage is how much of the filesystem holding path is in use, in percent.
+// Space reserved for root counts as used, as we can't have it anyway.
+func diskUsage(path string) (float64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, nil
+	}
+	return 100 * (1 - float64(stat.Bavail)/float64(stat.Blocks)), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package storage
+
+import "errors"
+
+func diskUsage(path string) (float64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// readTracker notices if any content was actually read, as opposed to just looked at.
+type readTracker struct {
+	Blob
+	read bool
+}
+
+func (rt *readTracker) Read(p []byte) (int, error) {
+	rt.read = true
+	return rt.Blob.Read(p)
+}
+
+// getLimitedEntry is GetEntry for entries that can only be downloaded so many times.
+// A download is taken before the content is handed over, so nobody gets one too
+// many, and given back if none of the content was read after all, like when the
+// client already had it, or didn't have the password.
+func (eh BoltDatabase) getLimitedEntry(pile string, entry string, get GetWithFunc, tracker *readTracker) error {
+	entryMeta := EntryMeta{}
+	err := eh.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		entryMeta, err = eh.getLiveEntryMeta(tx, pile, entry)
+		if err != nil {
+			return err
+		}
+		entryMeta = entryMeta.WithDownloads(entryMeta.DownloadsLeft() - 1)
+		return putEntryMeta(tx, pile, entry, entryMeta)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = eh.serveEntry(pile, entry, entryMeta, get, tracker)
+	if settleErr := eh.settleDownload(pile, entry, entryMeta, tracker.read); settleErr != nil {
+		log.Error().Err(settleErr).Str("operation", "read").Str("pile", pile).Str("entry", entry).Msg("Could not settle a limited download")
+	}
+	return err
+}
+
+func (eh BoltDatabase) settleDownload(pile string, entry string, taken EntryMeta, read bool) error {
+	key := blobKey(pile, entry, taken)
+	return eh.db.Update(func(tx *bbolt.Tx) error {
+		current, err := getEntryMeta(tx, pile, entry)
+		unchanged := err == nil && current.IsLimited() && blobKey(pile, entry, current) == key
+		if !read && unchanged {
+			return putEntryMeta(tx, pile, entry, current.WithDownloads(current.DownloadsLeft()+1))
+		}
+		if !taken.IsExhausted() {
+			return nil
+		}
+		// That was the last download, so getting rid of it is up to us. Unless it's
+		// on hold, then it's up to whoever releases it.
+		log.Info().Str("operation", "read").Str("pile", pile).Str("entry", entry).Msg("Downloaded for the last time!")
+		if err == nil && current.IsHeld() && blobKey(pile, entry, current) == key {
+			return nil
+		}
+		if err == nil && current.IsExhausted() && blobKey(pile, entry, current) == key {
+			prune, err := bury(tx, eh.config, pile, entry, current, TOMBSTONE_DOWNLOADED, time.Now())
+			if err != nil {
+				return err
+			}
+			eh.alarm.consider(prune)
+		}
+		if err := releaseBlob(tx, eh.blobs, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted content is sealed with AES-256-GCM in chunks, so it can be written as
+// it streams in, and read from anywhere without decrypting everything before it.
+// Each blob is sealed with a key of its own, derived from the pile key and a random
+// salt with HKDF, so no two blobs ever share a nonce, however many there are. Each
+// chunk's nonce is the chunk number and a flag on the last chunk, so chunks can't be
+// reordered or cut off. Blobs from before the salt were sealed with the pile key
+// itself, and a random nonce prefix to go with the chunk number.
+const (
+	SEAL_CHUNK_SIZE   = 64 * 1024
+	SEAL_KEY_SIZE     = 32
+	sealSaltSize      = 32
+	sealNoncePrefix   = 7
+	sealChunkOverhead = 16
+	sealKeyInfo       = "boltpile blob"
+)
+
+type encryptionKey struct {
+	id     string
+	secret []byte
+	aead   cipher.AEAD
+}
+
+func (ek encryptionKey) IsZero() bool {
+	return ek.aead == nil
+}
+
+// forBlob is what seals and opens the blob with the given salt, and the nonce prefix
+// that goes with it. A salt as short as a nonce prefix is from a blob sealed with the
+// pile key itself.
+func (ek encryptionKey) forBlob(salt []byte) (cipher.AEAD, []byte, error) {
+	if len(salt) == sealNoncePrefix {
+		return ek.aead, salt, nil
+	}
+	if len(salt) != sealSaltSize {
+		return nil, nil, fmt.Errorf("sealed with a salt of %d bytes", len(salt))
+	}
+	derived := make([]byte, SEAL_KEY_SIZE)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ek.secret, salt, []byte(sealKeyInfo)), derived); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(derived)
+	return aead, make([]byte, sealNoncePrefix), err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyring holds the keys of a pile. New content is sealed with the current one,
+// and the others are kept around to open what was sealed before a rotation.
+type keyring struct {
+	current encryptionKey
+	keys    map[string]encryptionKey
+}
+
+// keyID names a key without giving anything away about it.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// loadKeyring gets the keys of a pile from its config and key file, in that order,
+// with the first one being current. It's nil for piles that aren't encrypted.
+func loadKeyring(pileConfig PileConfig) (*keyring, error) {
+	encoded := append([]string{}, pileConfig.EncryptionKeys...)
+	if pileConfig.EncryptionKeyFile != "" {
+		fromFile, err := readKeyFile(pileConfig.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, fromFile...)
+	}
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	kr := &keyring{keys: map[string]encryptionKey{}}
+	for i, hexKey := range encoded {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil || len(key) != SEAL_KEY_SIZE {
+			return nil, fmt.Errorf("encryption key %d is not %d hex encoded bytes", i+1, SEAL_KEY_SIZE)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		ek := encryptionKey{id: keyID(key), secret: key, aead: aead}
+		if i == 0 {
+			kr.current = ek
+		}
+		kr.keys[ek.id] = ek
+	}
+	return kr, nil
+}
+
+// readKeyFile reads one hex encoded key per line, ignoring blank lines and # comments.
+func readKeyFile(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	defer file.Close()
+	keys := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, scanner.Err()
+}
+
+func loadKeyrings(config Config) (map[string]*keyring, error) {
+	keyrings := map[string]*keyring{}
+	for pile, pileConfig := range config.Piles {
+		kr, err := loadKeyring(pileConfig)
+		if err != nil {
+			return nil, fmt.Errorf("pile %s: %w", pile, err)
+		}
+		if kr != nil {
+			keyrings[pile] = kr
+		}
+	}
+	return keyrings, nil
+}
+
+func chunkNonce(prefix []byte, index int64, last bool) []byte {
+	nonce := make([]byte, sealNoncePrefix+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[sealNoncePrefix:], uint32(index))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// sealingWriter encrypts into dst. A chunk is only sealed once more data shows up
+// after it, as until then it might be the last one. Close seals whatever is left.
+type sealingWriter struct {
+	dst    io.Writer
+	key    encryptionKey
+	salt   []byte
+	aead   cipher.AEAD
+	prefix []byte
+	index  int64
+	buf    []byte
+}
+
+func newSealingWriter(dst io.Writer, key encryptionKey) (*sealingWriter, error) {
+	salt := make([]byte, sealSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, prefix, err := key.forBlob(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &sealingWriter{
+		dst:    dst,
+		key:    key,
+		salt:   salt,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, SEAL_CHUNK_SIZE+sealChunkOverhead),
+	}, nil
+}
+
+func (sw *sealingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(sw.buf) == SEAL_CHUNK_SIZE {
+			if err := sw.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(sw.buf[len(sw.buf):SEAL_CHUNK_SIZE], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (sw *sealingWriter) seal(last bool) error {
+	sealed := sw.aead.Seal(sw.buf[:0], chunkNonce(sw.prefix, sw.index, last), sw.buf, nil)
+	if _, err := sw.dst.Write(sealed); err != nil {
+		return err
+	}
+	sw.index++
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+func (sw *sealingWriter) Close() error {
+	return sw.seal(true)
+}
+
+// openingReader decrypts a sealed blob, a chunk at a time, wherever it's read from.
+type openingReader struct {
+	blob     Blob
+	aead     cipher.AEAD
+	prefix   []byte
+	chunks   int64
+	size     int64
+	position int64
+	index    int64
+	chunk    []byte
+}
+
+func newOpeningReader(blob Blob, key encryptionKey, salt []byte) (*openingReader, error) {
+	aead, prefix, err := key.forBlob(salt)
+	if err != nil {
+		return nil, err
+	}
+	sealedChunk := int64(SEAL_CHUNK_SIZE + sealChunkOverhead)
+	chunks := (blob.Size() + sealedChunk - 1) / sealedChunk
+	size := blob.Size() - chunks*sealChunkOverhead
+	if chunks == 0 || size < 0 {
+		return nil, errors.New("sealed blob is too short")
+	}
+	return &openingReader{
+		blob:   blob,
+		aead:   aead,
+		prefix: prefix,
+		chunks: chunks,
+		size:   size,
+		index:  -1,
+	}, nil
+}
+
+func (opr *openingReader) Size() int64 {
+	return opr.size
+}
+
+func (opr *openingReader) Read(p []byte) (int, error) {
+	if opr.position >= opr.size {
+		return 0, io.EOF
+	}
+	index := opr.position / SEAL_CHUNK_SIZE
+	if index != opr.index {
+		if err := opr.open(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, opr.chunk[opr.position-index*SEAL_CHUNK_SIZE:])
+	opr.position += int64(n)
+	return n, nil
+}
+
+func (opr *openingReader) open(index int64) error {
+	sealedChunk := int64(SEAL_CHUNK_SIZE + sealChunkOverhead)
+	offset := index * sealedChunk
+	if _, err := opr.blob.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, min(sealedChunk, opr.blob.Size()-offset))
+	if _, err := io.ReadFull(opr.blob, sealed); err != nil {
+		return err
+	}
+	chunk, err := opr.aead.Open(sealed[:0], chunkNonce(opr.prefix, index, index == opr.chunks-1), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", index, err)
+	}
+	opr.chunk = chunk
+	opr.index = index
+	return nil
+}
+
+func (opr *openingReader) Seek(offset int64, whence int) (int64, error) {
+	position := opr.position
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position += offset
+	case io.SeekEnd:
+		position = opr.size + offset
+	}
+	if position < 0 {
+		return opr.position, errors.New("seek to before the start of the content")
+	}
+	opr.position = position
+	return position, nil
+}
+
+func (opr *openingReader) Close() error {
+	return opr.blob.Close()
+}
@@ -0,0 +1,161 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DemmyDemon/boltpile/storage"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	oldKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	newKey = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff000102030405060708090a0b0c0d0e0f"
+)
+
+func TestEncryptedEntries(t *testing.T) {
+	blobs := storage.NewMemoryStore()
+	filename := filepath.Join(t.TempDir(), "boltpile.db")
+	open := func(pileConfig storage.PileConfig, startup bool) storage.BoltDatabase {
+		config := storage.Config{Piles: map[string]storage.PileConfig{"pile": pileConfig}}
+		eh, err := storage.OpenBoltDatabase(filename, config, blobs)
+		if err != nil {
+			t.Fatalf("opening database: %s", err)
+		}
+		if !startup {
+			return eh
+		}
+		if err := storage.Startup(config, eh.DB(), blobs); err != nil {
+			t.Fatalf("startup: %s", err)
+		}
+		return eh
+	}
+
+	eh := open(storage.PileConfig{EncryptionKeys: []string{oldKey}}, true)
+	contents := map[string]string{}
+	for _, size := range []int{0, 100, storage.SEAL_CHUNK_SIZE, 3*storage.SEAL_CHUNK_SIZE + 7} {
+		content := strings.Repeat("secret!", size/7+1)[:size]
+		entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "secret.txt"}, writeString(content))
+		if err != nil {
+			t.Fatalf("create: %s", err)
+		}
+		contents[entry] = content
+	}
+	held := ""
+	for entry := range contents {
+		held = entry
+	}
+	if err := eh.HoldEntry("pile", held); err != nil {
+		t.Fatalf("hold: %s", err)
+	}
+
+	check := func() {
+		t.Helper()
+		for entry, content := range contents {
+			meta, got, err := readEntry(t, eh, "pile", entry)
+			if err != nil {
+				t.Fatalf("get: %s", err)
+			}
+			if got != content {
+				t.Errorf("%d bytes came back as %d different ones", len(content), len(got))
+			}
+			if meta.KeyID() == "" {
+				t.Errorf("entry not sealed")
+			}
+			blob, err := blobs.Open(meta.Blob())
+			if err != nil {
+				t.Fatalf("open blob: %s", err)
+			}
+			stored, _ := io.ReadAll(blob)
+			if len(content) > 0 && bytes.Contains(stored, []byte("secret!")) {
+				t.Errorf("plaintext in the stored blob")
+			}
+		}
+	}
+	check()
+	entries, _ := eh.GetPileEntries("pile")
+	var before string
+	for _, meta := range entries {
+		before = meta.KeyID()
+	}
+	// As if from before there were tombstones, and rotated the way main does it, without starting up.
+	err := eh.DB().Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket([]byte("\x00tombstones"))
+	})
+	if err != nil {
+		t.Fatalf("deleting the tombstones: %s", err)
+	}
+	eh.Close()
+
+	eh = open(storage.PileConfig{EncryptionKeys: []string{newKey, oldKey}, Compression: storage.CODEC_GZIP}, false)
+	defer eh.Close()
+	rotated, err := eh.RotateKeys("pile")
+	if err != nil {
+		t.Fatalf("rotate: %s", err)
+	}
+	if rotated != len(contents) {
+		t.Errorf("rotated %d of %d entries", rotated, len(contents))
+	}
+	check()
+	entries, _ = eh.GetPileEntries("pile")
+	for _, meta := range entries {
+		if meta.KeyID() == before {
+			t.Errorf("entry still sealed with the old key")
+		}
+	}
+	if !entries[held].IsHeld() {
+		t.Errorf("held entry is no longer held after rotating")
+	}
+	if rotated, _ := eh.RotateKeys("pile"); rotated != 0 {
+		t.Errorf("rotated %d entries a second time", rotated)
+	}
+}
+
+func TestBlobsSealedWithThePileKey(t *testing.T) {
+	eh, blobs := openTestDatabase(t, onePile(storage.PileConfig{EncryptionKeys: []string{oldKey}}))
+	entry, err := eh.CreateEntry("pile", storage.UploadInfo{Filename: "secret.txt"}, writeString("from before salts"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	meta, _, err := readEntry(t, eh, "pile", entry)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if len(meta.Nonce()) != 32 {
+		t.Errorf("new blob sealed with a salt of %d bytes", len(meta.Nonce()))
+	}
+
+	// What that used to look like: one last chunk, sealed with the pile key and a nonce prefix.
+	key, _ := hex.DecodeString(oldKey)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	prefix := []byte{1, 2, 3, 4, 5, 6, 7}
+	nonce := append(append([]byte{}, prefix...), 0, 0, 0, 0, 1)
+	writer, err := blobs.Create()
+	if err != nil {
+		t.Fatalf("create blob: %s", err)
+	}
+	writer.Write(aead.Seal(nil, nonce, []byte("from before salts"), nil))
+	if err := writer.Commit("pile/legacy"); err != nil {
+		t.Fatalf("commit blob: %s", err)
+	}
+	legacy, err := meta.WithBlob("pile/legacy").WithEncryption(meta.KeyID(), prefix).Bytes()
+	if err != nil {
+		t.Fatalf("encode meta: %s", err)
+	}
+	err = eh.DB().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("pile")).Put([]byte(entry), legacy)
+	})
+	if err != nil {
+		t.Fatalf("put legacy meta: %s", err)
+	}
+	if _, content, err := readEntry(t, eh, "pile", entry); err != nil || content != "from before salts" {
+		t.Errorf("blob sealed with the pile key got %q, %v", content, err)
+	}
+}
@@ -1,21 +1,59 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"time"
 )
 
+// Tags for the fields of a version 2 entry. Each field is stored as the tag,
+// the length of the value as a uvarint, and then the value itself. Decoding
+// skips tags it doesn't know, so new fields can be added without a version 3.
+const (
+	metaFilename    uint8 = 1
+	metaSize        uint8 = 2
+	metaContentType uint8 = 3
+	metaDigest      uint8 = 4
+	metaPeer        uint8 = 5
+	metaBlob        uint8 = 6
+	metaCodec       uint8 = 7
+	metaStoredSize  uint8 = 8
+	metaKeyID       uint8 = 9
+	metaNonce       uint8 = 10
+	metaPassword    uint8 = 11
+	metaDownloads   uint8 = 12
+	metaExpires     uint8 = 13
+	metaHeld        uint8 = 14
+	metaSequence    uint8 = 15
+)
+
 type EntryMeta struct {
-	version  uint8
-	filename string
-	created  time.Time
+	version     uint8
+	filename    string
+	created     time.Time
+	size        int64
+	contentType string
+	digest      []byte
+	peer        string
+	blob        string
+	codec       string
+	storedSize  int64
+	keyID       string
+	nonce       []byte
+	password    []byte
+	limited     bool
+	downloads   uint64
+	expires     time.Time
+	held        time.Time
+	sequence    uint64
+	accessed    time.Time // Not stored with the rest, see accessLog.
 }
 
 func NewEntryMeta(filename string, created time.Time) EntryMeta {
 	return EntryMeta{
-		version:  1,
+		version:  2,
 		filename: filename,
 		created:  created,
 	}
@@ -28,6 +66,8 @@ func EntryMetaFromBytes(data []byte) (EntryMeta, error) {
 	switch version {
 	case 1:
 		return decodeVersionOne(data)
+	case 2:
+		return decodeVersionTwo(data)
 	default:
 		oldstyle := string(data)
 		timestamp, err := time.Parse(TIME_FORMAT, oldstyle)
@@ -42,8 +82,94 @@ func EntryMetaFromBytes(data []byte) (EntryMeta, error) {
 	}
 }
 
+// WithContent records what was found while the entry content was stored.
+func (em EntryMeta) WithContent(size int64, contentType string, digest []byte) EntryMeta {
+	em.size = size
+	em.contentType = contentType
+	em.digest = digest
+	return em
+}
+
+// withSize records the size of an entry stored before it was, from its blob.
+func (em EntryMeta) withSize(size int64) EntryMeta {
+	em.version = 2 // Version 1 has nowhere to put it.
+	em.size = size
+	return em
+}
+
+// WithPeer records who uploaded the entry.
+func (em EntryMeta) WithPeer(peer string) EntryMeta {
+	em.peer = peer
+	return em
+}
+
+// WithBlob records where the content is kept, when that's not just pile/entry.
+func (em EntryMeta) WithBlob(key string) EntryMeta {
+	em.blob = key
+	return em
+}
+
+// WithEncoding records that the content is stored compressed, and how big it is like that.
+func (em EntryMeta) WithEncoding(codec string, storedSize int64) EntryMeta {
+	em.codec = codec
+	em.storedSize = storedSize
+	return em
+}
+
+// WithEncryption records which key the content is sealed with, and the salt its blob
+// key was derived with, or for older blobs, the nonce prefix used.
+func (em EntryMeta) WithEncryption(keyID string, nonce []byte) EntryMeta {
+	em.keyID = keyID
+	em.nonce = nonce
+	return em
+}
+
+// withPasswordHash protects the entry with a password, as hashed by hashPassword.
+func (em EntryMeta) withPasswordHash(hash []byte) EntryMeta {
+	em.password = hash
+	return em
+}
+
+// WithDownloads limits how many more times the entry can be downloaded.
+func (em EntryMeta) WithDownloads(downloads uint64) EntryMeta {
+	em.limited = true
+	em.downloads = downloads
+	return em
+}
+
+// WithExpiry has the entry expire at the given time, regardless of the pile lifetime.
+func (em EntryMeta) WithExpiry(expires time.Time) EntryMeta {
+	em.version = 2 // Version 1 has nowhere to put it.
+	em.expires = expires
+	return em
+}
+
+// WithHold puts the entry on hold as of the given time, or releases it with the
+// zero time. Entries on hold are kept around, whatever their lifetime.
+func (em EntryMeta) WithHold(since time.Time) EntryMeta {
+	em.version = 2 // Version 1 has nowhere to put it.
+	em.held = since
+	return em
+}
+
+// withSequence numbers the upload, to tell apart the order of those in the same second.
+func (em EntryMeta) withSequence(sequence uint64) EntryMeta {
+	em.version = 2 // Version 1 has nowhere to put it.
+	em.sequence = sequence
+	return em
+}
+
+// withAccess notes when the entry was last downloaded, in piles with sliding expiry.
+func (em EntryMeta) withAccess(accessed time.Time) EntryMeta {
+	em.accessed = accessed
+	return em
+}
+
 func (em EntryMeta) Bytes() ([]byte, error) {
-	return encodeVersionOne(em)
+	if em.version == 1 {
+		return encodeVersionOne(em)
+	}
+	return encodeVersionTwo(em)
 }
 
 func (em EntryMeta) String() string {
@@ -55,10 +181,121 @@ func (em EntryMeta) Filename() string {
 func (em EntryMeta) Time() time.Time {
 	return em.created
 }
+
+// Expires is when the entry is up, given the lifetime of its pile. That's whenever
+// the uploader asked for, if they did, pushed back by however long after upload
+// it was last downloaded, with sliding expiry. The zero time means never, which
+// is also the case for as long as it's on hold.
+func (em EntryMeta) Expires(lifetime time.Duration) time.Time {
+	if em.IsHeld() {
+		return time.Time{}
+	}
+	expires := em.expires
+	if expires.IsZero() {
+		if lifetime <= 0 {
+			return time.Time{}
+		}
+		expires = em.created.Add(lifetime)
+	}
+	if em.accessed.After(em.created) {
+		expires = expires.Add(em.accessed.Sub(em.created))
+	}
+	return expires
+}
+
+// LastAccess is when the entry was last downloaded, if that's being kept track of.
+func (em EntryMeta) LastAccess() time.Time {
+	return em.accessed
+}
+
+// IsExpired is Expires being in the past.
+func (em EntryMeta) IsExpired(lifetime time.Duration, now time.Time) bool {
+	expires := em.Expires(lifetime)
+	return !expires.IsZero() && now.After(expires)
+}
+func (em EntryMeta) IsHeld() bool {
+	return !em.held.IsZero()
+}
+
+// HeldSince is when the entry was put on hold, or the zero time if it isn't.
+func (em EntryMeta) HeldSince() time.Time {
+	return em.held
+}
 func (em EntryMeta) IsZero() bool {
 	return em.filename == ""
 }
 
+// HasContentInfo is false for entries stored before size, MIME type and digest were recorded.
+func (em EntryMeta) HasContentInfo() bool {
+	return em.contentType != ""
+}
+func (em EntryMeta) Size() int64 {
+	return em.size
+}
+func (em EntryMeta) ContentType() string {
+	return em.contentType
+}
+
+// Digest is the SHA-256 of the entry content, or nil if it wasn't recorded.
+func (em EntryMeta) Digest() []byte {
+	return em.digest
+}
+func (em EntryMeta) Peer() string {
+	return em.peer
+}
+
+// Blob is the BlobStore key of the content, or empty for entries stored under pile/entry.
+func (em EntryMeta) Blob() string {
+	return em.blob
+}
+
+// Codec is what the content is compressed with, or empty if it isn't.
+func (em EntryMeta) Codec() string {
+	return em.codec
+}
+
+// StoredSize is the size of the content as compressed by the codec.
+func (em EntryMeta) StoredSize() int64 {
+	return em.storedSize
+}
+
+// KeyID names the key the content is encrypted with, or is empty if it isn't.
+func (em EntryMeta) KeyID() string {
+	return em.keyID
+}
+func (em EntryMeta) Nonce() []byte {
+	return em.nonce
+}
+
+func (em EntryMeta) HasPassword() bool {
+	return em.password != nil
+}
+
+func (em EntryMeta) IsLimited() bool {
+	return em.limited
+}
+func (em EntryMeta) DownloadsLeft() uint64 {
+	return em.downloads
+}
+
+// IsExhausted is true for entries that were downloaded as many times as they could
+// be. When the last download settles, the entry is removed and left as a tombstone,
+// so anyone coming for it can be told as much. Entries on hold wait for the release.
+func (em EntryMeta) IsExhausted() bool {
+	return em.limited && em.downloads == 0
+}
+
+// SamePassword is true if both need the same password, or neither needs one. It's
+// quick, unlike CheckPassword, so it can tell if a password checked a while ago still goes.
+func (em EntryMeta) SamePassword(other EntryMeta) bool {
+	return bytes.Equal(em.password, other.password)
+}
+
+// CheckPassword is deliberately slow, so guessing is too.
+func (em EntryMeta) CheckPassword(password string) bool {
+	return checkPassword(em.password, password)
+}
+
 func encodeVersionOne(em EntryMeta) ([]byte, error) {
 	data := make([]byte, 0, 24)
 	data, err := binary.Append(data, binary.LittleEndian, em.version)
@@ -87,3 +324,138 @@ func decodeVersionOne(data []byte) (EntryMeta, error) {
 	entry.filename = string(data[9:])
 	return entry, nil
 }
+
+func appendMetaField(data []byte, tag uint8, value []byte) []byte {
+	data = append(data, tag)
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func encodeVersionTwo(em EntryMeta) ([]byte, error) {
+	data := make([]byte, 0, 128)
+	data, err := binary.Append(data, binary.LittleEndian, uint8(2))
+	if err != nil {
+		return data, err
+	}
+	data, err = binary.Append(data, binary.LittleEndian, em.created.Unix())
+	if err != nil {
+		return data, err
+	}
+	data = appendMetaField(data, metaFilename, []byte(em.filename))
+	if em.contentType != "" || em.size != 0 {
+		data = appendMetaField(data, metaSize, binary.LittleEndian.AppendUint64(nil, uint64(em.size)))
+	}
+	if em.contentType != "" {
+		data = appendMetaField(data, metaContentType, []byte(em.contentType))
+	}
+	if em.digest != nil {
+		data = appendMetaField(data, metaDigest, em.digest)
+	}
+	if em.peer != "" {
+		data = appendMetaField(data, metaPeer, []byte(em.peer))
+	}
+	if em.blob != "" {
+		data = appendMetaField(data, metaBlob, []byte(em.blob))
+	}
+	if em.codec != "" {
+		data = appendMetaField(data, metaCodec, []byte(em.codec))
+		data = appendMetaField(data, metaStoredSize, binary.LittleEndian.AppendUint64(nil, uint64(em.storedSize)))
+	}
+	if em.keyID != "" {
+		data = appendMetaField(data, metaKeyID, []byte(em.keyID))
+		data = appendMetaField(data, metaNonce, em.nonce)
+	}
+	if em.password != nil {
+		data = appendMetaField(data, metaPassword, em.password)
+	}
+	if em.limited {
+		data = appendMetaField(data, metaDownloads, binary.LittleEndian.AppendUint64(nil, em.downloads))
+	}
+	if !em.expires.IsZero() {
+		data = appendMetaField(data, metaExpires, binary.LittleEndian.AppendUint64(nil, uint64(em.expires.Unix())))
+	}
+	if !em.held.IsZero() {
+		data = appendMetaField(data, metaHeld, binary.LittleEndian.AppendUint64(nil, uint64(em.held.Unix())))
+	}
+	if em.sequence != 0 {
+		data = appendMetaField(data, metaSequence, binary.LittleEndian.AppendUint64(nil, em.sequence))
+	}
+	return data, nil
+}
+
+func decodeVersionTwo(data []byte) (EntryMeta, error) {
+	entry := EntryMeta{
+		version: uint8(data[0]),
+	}
+	if len(data) < 9 {
+		return entry, errors.New("version 2 entry metadata too short")
+	}
+	entry.created = time.Unix(int64(binary.LittleEndian.Uint64(data[1:9])), 0)
+
+	reader := bytes.NewReader(data[9:])
+	for reader.Len() > 0 {
+		tag, _ := reader.ReadByte()
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return entry, fmt.Errorf("decoding length of field %d: %w", tag, err)
+		}
+		if length > uint64(reader.Len()) {
+			return entry, fmt.Errorf("field %d claims %d bytes, but only %d remain", tag, length, reader.Len())
+		}
+		value := make([]byte, length)
+		reader.Read(value)
+
+		switch tag {
+		case metaFilename:
+			entry.filename = string(value)
+		case metaSize:
+			if length != 8 {
+				return entry, fmt.Errorf("size field is %d bytes, expected 8", length)
+			}
+			entry.size = int64(binary.LittleEndian.Uint64(value))
+		case metaContentType:
+			entry.contentType = string(value)
+		case metaDigest:
+			entry.digest = value
+		case metaPeer:
+			entry.peer = string(value)
+		case metaBlob:
+			entry.blob = string(value)
+		case metaCodec:
+			entry.codec = string(value)
+		case metaStoredSize:
+			if length != 8 {
+				return entry, fmt.Errorf("stored size field is %d bytes, expected 8", length)
+			}
+			entry.storedSize = int64(binary.LittleEndian.Uint64(value))
+		case metaKeyID:
+			entry.keyID = string(value)
+		case metaNonce:
+			entry.nonce = value
+		case metaPassword:
+			entry.password = value
+		case metaDownloads:
+			if length != 8 {
+				return entry, fmt.Errorf("downloads field is %d bytes, expected 8", length)
+			}
+			entry.limited = true
+			entry.downloads = binary.LittleEndian.Uint64(value)
+		case metaExpires:
+			if length != 8 {
+				return entry, fmt.Errorf("expires field is %d bytes, expected 8", length)
+			}
+			entry.expires = time.Unix(int64(binary.LittleEndian.Uint64(value)), 0)
+		case metaHeld:
+			if length != 8 {
+				return entry, fmt.Errorf("held field is %d bytes, expected 8", length)
+			}
+			entry.held = time.Unix(int64(binary.LittleEndian.Uint64(value)), 0)
+		case metaSequence:
+			if length != 8 {
+				return entry, fmt.Errorf("sequence field is %d bytes, expected 8", length)
+			}
+			entry.sequence = binary.LittleEndian.Uint64(value)
+		}
+	}
+	return entry, nil
+}
@@ -1,6 +1,9 @@
 package storage_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"testing"
 	"time"
 
@@ -44,3 +47,76 @@ func TestEntryMetaDecodeOldValue(t *testing.T) {
 		return
 	}
 }
+
+func TestEntryMetaContentEncoding(t *testing.T) {
+	now := time.Now().UTC()
+	digest := sha256.Sum256([]byte("dummy content"))
+	meta := storage.NewEntryMeta("dummy_filename.txt", now).
+		WithContent(13, "text/plain; charset=utf-8", digest[:]).
+		WithPeer("192.0.2.1")
+	data, err := meta.Bytes()
+	if err != nil {
+		t.Errorf("encoding: %s", err)
+		return
+	}
+	anotherMeta, err := storage.EntryMetaFromBytes(data)
+	if err != nil {
+		t.Errorf("decoding: %s", err)
+		return
+	}
+	if !anotherMeta.HasContentInfo() {
+		t.Errorf("content info went missing")
+		return
+	}
+	if anotherMeta.Size() != 13 {
+		t.Errorf("size %d != 13", anotherMeta.Size())
+	}
+	if anotherMeta.ContentType() != meta.ContentType() {
+		t.Errorf("%q != %q", meta.ContentType(), anotherMeta.ContentType())
+	}
+	if !bytes.Equal(anotherMeta.Digest(), digest[:]) {
+		t.Errorf("digest %x != %x", anotherMeta.Digest(), digest)
+	}
+	if anotherMeta.Peer() != "192.0.2.1" {
+		t.Errorf("%q != %q", "192.0.2.1", anotherMeta.Peer())
+	}
+	if anotherMeta.Filename() != "dummy_filename.txt" {
+		t.Errorf("%q != %q", "dummy_filename.txt", anotherMeta.Filename())
+	}
+}
+
+func TestEntryMetaDecodeVersionOne(t *testing.T) {
+	now := time.Now().UTC()
+	data := []byte{1}
+	data = binary.LittleEndian.AppendUint64(data, uint64(now.Unix()))
+	data = append(data, []byte("old_filename.jpg")...)
+	meta, err := storage.EntryMetaFromBytes(data)
+	if err != nil {
+		t.Errorf("decoding: %s", err)
+		return
+	}
+	if now.Unix() != meta.Time().Unix() {
+		t.Errorf("encoded and decoded times do not match (encoded %s, decoded %s)", now.Format(storage.TIME_FORMAT), meta.Time().Format(storage.TIME_FORMAT))
+	}
+	if meta.Filename() != "old_filename.jpg" {
+		t.Errorf("%q != %q", "old_filename.jpg", meta.Filename())
+	}
+	if meta.HasContentInfo() {
+		t.Errorf("version 1 metadata should not have content info")
+	}
+	if _, err := meta.Bytes(); err != nil {
+		t.Errorf("re-encoding: %s", err)
+	}
+}
+
+func TestEntryMetaDecodeTruncated(t *testing.T) {
+	meta := storage.NewEntryMeta("dummy_filename.txt", time.Now())
+	data, err := meta.Bytes()
+	if err != nil {
+		t.Errorf("encoding: %s", err)
+		return
+	}
+	if _, err := storage.EntryMetaFromBytes(data[:len(data)-3]); err == nil {
+		t.Errorf("truncated metadata decoded without error")
+	}
+}
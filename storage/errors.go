@@ -1,6 +1,9 @@
 package storage
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type ErrNoSuchPile struct {
 	Pile string
@@ -28,6 +31,10 @@ func (err ErrUnparsableMeta) Error() string {
 	return fmt.Sprintf("failed to parse entry metadata: %s", err.ParseError.Error())
 }
 
+func (err ErrUnparsableMeta) Unwrap() error {
+	return err.ParseError
+}
+
 type ErrFailedMakingId struct {
 	UpstreamError error
 }
@@ -36,6 +43,10 @@ func (err ErrFailedMakingId) Error() string {
 	return fmt.Sprintf("failed to make an entry ID: %s", err.UpstreamError.Error())
 }
 
+func (err ErrFailedMakingId) Unwrap() error {
+	return err.UpstreamError
+}
+
 type ErrFailedCreatingPileDirectory struct {
 	Pile          string
 	UpstreamError error
@@ -45,6 +56,10 @@ func (err ErrFailedCreatingPileDirectory) Error() string {
 	return fmt.Sprintf("failed to make a directory for pile %s: %s", err.Pile, err.UpstreamError.Error())
 }
 
+func (err ErrFailedCreatingPileDirectory) Unwrap() error {
+	return err.UpstreamError
+}
+
 type ErrFailedCreatingEntryFile struct {
 	Pile          string
 	Entry         string
@@ -55,6 +70,10 @@ func (err ErrFailedCreatingEntryFile) Error() string {
 	return fmt.Sprintf("failed to make file for entry %s/%s: %s", err.Pile, err.Entry, err.UpstreamError.Error())
 }
 
+func (err ErrFailedCreatingEntryFile) Unwrap() error {
+	return err.UpstreamError
+}
+
 type ErrDuringFileOperation struct {
 	Pile          string
 	Entry         string
@@ -65,6 +84,10 @@ func (err ErrDuringFileOperation) Error() string {
 	return fmt.Sprintf("failed file operation on %s/%s: %s", err.Pile, err.Entry, err.UpstreamError.Error())
 }
 
+func (err ErrDuringFileOperation) Unwrap() error {
+	return err.UpstreamError
+}
+
 type ErrFailedStoringEntryMetadata struct {
 	Pile          string
 	Entry         string
@@ -74,3 +97,142 @@ type ErrFailedStoringEntryMetadata struct {
 func (err ErrFailedStoringEntryMetadata) Error() string {
 	return fmt.Sprintf("error putting %s/%s metadata into database: %s", err.Pile, err.Entry, err.UpstreamError)
 }
+
+func (err ErrFailedStoringEntryMetadata) Unwrap() error {
+	return err.UpstreamError
+}
+
+type ErrFailedDeletingEntryMetadata struct {
+	Pile          string
+	Entry         string
+	UpstreamError error
+}
+
+func (err ErrFailedDeletingEntryMetadata) Error() string {
+	return fmt.Sprintf("error removing %s/%s metadata from database: %s", err.Pile, err.Entry, err.UpstreamError)
+}
+
+func (err ErrFailedDeletingEntryMetadata) Unwrap() error {
+	return err.UpstreamError
+}
+
+type ErrMissingEncryptionKey struct {
+	Pile  string
+	Entry string
+	KeyID string
+}
+
+func (err ErrMissingEncryptionKey) Error() string {
+	return fmt.Sprintf("%s/%s: encrypted with key %s, which is not configured", err.Pile, err.Entry, err.KeyID)
+}
+
+type ErrEntryGone struct {
+	Pile   string
+	Entry  string
+	Reason string
+	Time   time.Time
+}
+
+func (err ErrEntryGone) Error() string {
+	return fmt.Sprintf("%s/%s: entry is gone, %s %s", err.Pile, err.Entry, err.Reason, err.Time.Format(TIME_FORMAT))
+}
+
+type ErrEntryHeld struct {
+	Pile  string
+	Entry string
+}
+
+func (err ErrEntryHeld) Error() string {
+	return fmt.Sprintf("%s/%s: entry is on hold", err.Pile, err.Entry)
+}
+
+type ErrNotInTrash struct {
+	Pile  string
+	Entry string
+}
+
+func (err ErrNotInTrash) Error() string {
+	return fmt.Sprintf("%s/%s: not in the trash", err.Pile, err.Entry)
+}
+
+type ErrEntryExists struct {
+	Pile  string
+	Entry string
+}
+
+func (err ErrEntryExists) Error() string {
+	return fmt.Sprintf("%s/%s: entry already exists", err.Pile, err.Entry)
+}
+
+type ErrUnacceptableFilename struct {
+	Filename string
+}
+
+func (err ErrUnacceptableFilename) Error() string {
+	return fmt.Sprintf("%q can not be used as an entry name", err.Filename)
+}
+
+type ErrPileFull struct {
+	Pile string
+}
+
+func (err ErrPileFull) Error() string {
+	return fmt.Sprintf("%s: pile is full", err.Pile)
+}
+
+type ErrUnacceptableLifetime struct {
+	Pile     string
+	Lifetime time.Duration
+}
+
+func (err ErrUnacceptableLifetime) Error() string {
+	return fmt.Sprintf("%s: a lifetime of %s is not allowed", err.Pile, err.Lifetime)
+}
+
+type ErrNoSuchUpload struct {
+	Pile   string
+	Upload string
+}
+
+func (err ErrNoSuchUpload) Error() string {
+	return fmt.Sprintf("%s/%s: no such upload", err.Pile, err.Upload)
+}
+
+type ErrUploadOffsetMismatch struct {
+	Pile     string
+	Upload   string
+	Expected int64
+	Got      int64
+}
+
+func (err ErrUploadOffsetMismatch) Error() string {
+	return fmt.Sprintf("%s/%s: upload is at offset %d, not %d", err.Pile, err.Upload, err.Expected, err.Got)
+}
+
+type ErrUploadLocked struct {
+	Pile   string
+	Upload string
+}
+
+func (err ErrUploadLocked) Error() string {
+	return fmt.Sprintf("%s/%s: upload is busy with another request", err.Pile, err.Upload)
+}
+
+type ErrUploadTooLong struct {
+	Pile   string
+	Upload string
+	Length int64
+}
+
+func (err ErrUploadTooLong) Error() string {
+	return fmt.Sprintf("%s/%s: got more than the declared %d bytes", err.Pile, err.Upload, err.Length)
+}
+
+type ErrDiskFull struct {
+	Pile string
+	Used float64
+}
+
+func (err ErrDiskFull) Error() string {
+	return fmt.Sprintf("%s: disk is %.1f%% full", err.Pile, err.Used)
+}
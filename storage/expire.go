@@ -1,85 +1,287 @@
 package storage
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"go.etcd.io/bbolt"
 )
 
+// Entries that expire are listed in the expiry bucket, under when they do, so
+// whatever is due is right at the start and nothing else has to be looked at.
+// The index is rebuilt at startup, as that's when pile lifetimes can change.
+const (
+	EXPIRE_BATCH_SIZE = 256
+	EXPIRE_IDLE_WAIT  = 24 * time.Hour  // When nothing is due, this is how long until we check anyway.
+	EXPIRE_RETRY_WAIT = 5 * time.Minute // How long until entries that couldn't be voided are tried again.
+)
+
 func DeleteExpiredFile(pile, entry string) error {
 	return errors.New("not implemented")
 }
 
-func VoidExpired(config Config, db *bbolt.DB) {
+// expiryKey is the expiry time in big endian seconds, so they sort right, and then pile/entry.
+func expiryKey(expires time.Time, pile string, entry string) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	return append(key, accessKey(pile, entry)...)
+}
+
+func parseExpiryKey(key []byte) (time.Time, string, string) {
+	if len(key) < 8 {
+		return time.Time{}, "", ""
+	}
+	pile, entry, _ := strings.Cut(string(key[8:]), "/")
+	return time.Unix(int64(binary.BigEndian.Uint64(key)), 0), pile, entry
+}
+
+// entryExpires is when the entry expires, as far as the database knows. Downloads
+// that aren't flushed yet don't count, but VoidExpired checks again anyway.
+func entryExpires(tx *bbolt.Tx, pileConfig PileConfig, pile string, entry string, entryMeta EntryMeta) time.Time {
+	if pileConfig.SlidingExpiry {
+		entryMeta = entryMeta.withAccess(lastAccess(tx, pile, entry))
+	}
+	return entryMeta.Expires(pileConfig.Lifetime.Duration)
+}
+
+func indexExpiry(tx *bbolt.Tx, pileConfig PileConfig, pile string, entry string, entryMeta EntryMeta) (time.Time, error) {
+	expires := entryExpires(tx, pileConfig, pile, entry, entryMeta)
+	if expires.IsZero() {
+		return expires, nil
+	}
+	return expires, tx.Bucket(expiryBucket).Put(expiryKey(expires, pile, entry), nil)
+}
+
+func unindexExpiry(tx *bbolt.Tx, pileConfig PileConfig, pile string, entry string, entryMeta EntryMeta) error {
+	expires := entryExpires(tx, pileConfig, pile, entry, entryMeta)
+	if expires.IsZero() {
+		return nil
+	}
+	return tx.Bucket(expiryBucket).Delete(expiryKey(expires, pile, entry))
+}
+
+// VoidExpired gets rid of everything that's due, a batch per transaction, so
+// nobody waits on it for long. It returns when the next entry is due, if ever.
+// Entries that can't be voided are skipped, and tried again a while later.
+func VoidExpired(config Config, db *bbolt.DB, blobs BlobStore) time.Time {
 	now := time.Now()
-	err := db.Update(func(tx *bbolt.Tx) error {
-		for pile, data := range config.Piles {
-			debug := log.Debug().Str("pile", pile).Str("operation", "expire")
-			if data.Lifetime.Seconds() > 0 {
-				debug = debug.Str("lifetime", data.Lifetime.String())
-				bucket := tx.Bucket([]byte(pile))
-				if bucket == nil {
-					return fmt.Errorf("Pile %s does not have a bucket", pile)
+	expired := 0
+	failed := map[string]bool{}
+	for {
+		due := [][]byte{}
+		voided := 0
+		err := db.Update(func(tx *bbolt.Tx) error {
+			cursor := tx.Bucket(expiryBucket).Cursor()
+			for k, _ := cursor.First(); k != nil && len(due) < EXPIRE_BATCH_SIZE; k, _ = cursor.Next() {
+				if expires, _, _ := parseExpiryKey(k); expires.After(now) {
+					break
 				}
-				debug = debug.Int("keys", bucket.Stats().KeyN)
-				expired := []string{}
-				bucket.ForEach(func(k, v []byte) error {
-					entry := string(k)
-					entryMeta, err := EntryMetaFromBytes(v)
-					if err != nil {
-						return fmt.Errorf("parsing pile %s entry %s time: %w", pile, entry, err)
-					}
-					expires := entryMeta.Time().Add(data.Lifetime.Duration)
-					if now.After(expires) {
-						expired = append(expired, entry)
+				if !failed[string(k)] {
+					due = append(due, append([]byte{}, k...))
+				}
+			}
+			for _, key := range due {
+				ok, err := voidIndexed(tx, config, blobs, key, now)
+				if err != nil {
+					return err
+				}
+				if ok {
+					voided++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// Something in the batch is bad, so it's one at a time to keep that from holding up the rest.
+			log.Error().Err(err).Msg("Error during VoidExpire operation")
+			voided = 0
+			for _, key := range due {
+				err := db.Update(func(tx *bbolt.Tx) error {
+					ok, err := voidIndexed(tx, config, blobs, key, now)
+					if ok && err == nil {
+						voided++
 					}
-					return nil
+					return err
 				})
-				for _, entry := range expired {
-					log.Info().Str("operation", "expire").Str("pile", pile).Str("entry", entry).Msg("Expired!")
-					if err := bucket.Delete([]byte(entry)); err != nil {
-						return fmt.Errorf("delete expired entry %s in bolt: %w", entry, err)
-					}
-					path := filepath.Join("piles", pile, entry)
-					if err := os.Remove(path); err != nil {
-						if !os.IsNotExist(err) {
-							return fmt.Errorf("delete expired file %s: %w", entry, err)
-						}
-						log.Warn().Str("operation", "expire").Str("pile", pile).Str("entry", entry).Msg("Expired file already doesn't exist!")
-					}
+				if err != nil {
+					_, pile, entry := parseExpiryKey(key)
+					log.Error().Err(err).Str("pile", pile).Str("entry", entry).Msg("Could not void, will try again later")
+					failed[string(key)] = true
 				}
-				debug.Int("expired", len(expired)).Msg("OK")
-			} else {
-				debug.Msg("Entries do not expire")
+			}
+		}
+		expired += voided
+		if len(due) < EXPIRE_BATCH_SIZE {
+			break
+		}
+	}
+
+	next := time.Time{}
+	db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(expiryBucket).Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			if !failed[string(k)] {
+				next, _, _ = parseExpiryKey(k)
+				break
 			}
 		}
 		return nil
 	})
+	if retry := now.Add(EXPIRE_RETRY_WAIT); len(failed) > 0 && (next.IsZero() || next.After(retry)) {
+		next = retry
+	}
+	debug := log.Debug().Str("operation", "expire").Int("expired", expired).Int("failed", len(failed))
+	if !next.IsZero() {
+		debug = debug.Str("next", next.UTC().Format(TIME_FORMAT))
+	}
+	debug.Msg("OK")
+	return next
+}
+
+// voidIndexed takes an entry off the index, and voids it, if it really is expired.
+// The index can be behind on downloads in piles with sliding expiry, so entries
+// that turn out to still be good are put back where they belong.
+func voidIndexed(tx *bbolt.Tx, config Config, blobs BlobStore, key []byte, now time.Time) (bool, error) {
+	if err := tx.Bucket(expiryBucket).Delete(key); err != nil {
+		return false, err
+	}
+	_, pile, entry := parseExpiryKey(key)
+	// The trash of an entry can be due whether or not there's a new one by that name.
+	if _, err := purgeTrash(tx, config, blobs, pile, entry, now); err != nil {
+		return false, err
+	}
+	entryMeta, err := getEntryMeta(tx, pile, entry)
 	if err != nil {
-		log.Error().Err(err).Msg("Error during VoidExpire operation")
+		// Either a tombstone that's due, or it's long gone and the index didn't get the memo.
+		_, err := pruneTombstone(tx, config, pile, entry, now)
+		return false, err
+	}
+	pileConfig := config.Piles[pile]
+	expires := entryExpires(tx, pileConfig, pile, entry, entryMeta)
+	if expires.IsZero() {
+		return false, nil
+	}
+	if expires.After(now) {
+		_, err := indexExpiry(tx, pileConfig, pile, entry, entryMeta)
+		return false, err
+	}
+
+	log.Info().Str("operation", "expire").Str("pile", pile).Str("entry", entry).Msg("Expired!")
+	return true, voidEntry(tx, config, blobs, pile, entry, entryMeta, TOMBSTONE_EXPIRED, expires, true)
+}
+
+// voidEntry buries an entry, and puts its content in the trash, or lets go of it.
+func voidEntry(tx *bbolt.Tx, config Config, blobs BlobStore, pile string, entry string, entryMeta EntryMeta, reason string, when time.Time, trash bool) error {
+	if _, err := bury(tx, config, pile, entry, entryMeta, reason, when); err != nil {
+		return fmt.Errorf("delete %s entry %s in bolt: %w", reason, entry, err)
 	}
+	if entryMeta.IsExhausted() {
+		return nil // Its content went with the last download.
+	}
+	if trash {
+		if _, err := discard(tx, config, blobs, pile, entry, entryMeta, reason, when); err != nil {
+			return fmt.Errorf("discard %s file %s: %w", reason, entry, err)
+		}
+		return nil
+	}
+	if err := releaseBlob(tx, blobs, blobKey(pile, entry, entryMeta)); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("delete %s file %s: %w", reason, entry, err)
+		}
+		log.Warn().Str("reason", reason).Str("pile", pile).Str("entry", entry).Msg("Voided file already doesn't exist!")
+	}
+	return nil
+}
+
+// expiryAlarm is how the expire loop finds out about entries that are due sooner
+// than whatever it's currently waiting for.
+type expiryAlarm struct {
+	mu         sync.Mutex
+	next       time.Time
+	considered time.Time
+	wake       chan struct{}
+}
+
+func newExpiryAlarm() *expiryAlarm {
+	return &expiryAlarm{wake: make(chan struct{}, 1)}
+}
+
+func (ea *expiryAlarm) consider(expires time.Time) {
+	if expires.IsZero() {
+		return
+	}
+	ea.mu.Lock()
+	defer ea.mu.Unlock()
+	if ea.considered.IsZero() || expires.Before(ea.considered) {
+		ea.considered = expires
+	}
+	if ea.next.IsZero() || expires.Before(ea.next) {
+		ea.next = expires
+		select {
+		case ea.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reset is for after a pass, with when the next entry is due. Anything considered
+// in the meantime might have been missed by the pass, so that's kept if sooner.
+func (ea *expiryAlarm) reset(next time.Time) {
+	ea.mu.Lock()
+	defer ea.mu.Unlock()
+	if !ea.considered.IsZero() && (next.IsZero() || ea.considered.Before(next)) {
+		next = ea.considered
+	}
+	ea.next = next
+	ea.considered = time.Time{}
+}
+
+func (ea *expiryAlarm) wait() time.Duration {
+	ea.mu.Lock()
+	defer ea.mu.Unlock()
+	if ea.next.IsZero() {
+		return EXPIRE_IDLE_WAIT
+	}
+	return max(time.Until(ea.next), 0)
 }
 
 type QuitSignalChan chan<- interface{}
 
-func StartExpireLoop(interval time.Duration, config Config, db *bbolt.DB) QuitSignalChan {
+// StartExpireLoop voids expired entries when the next one is due. Every interval,
+// it also writes down recent downloads, and gets rid of stale uploads.
+func (eh BoltDatabase) StartExpireLoop(interval time.Duration) QuitSignalChan {
 
-	VoidExpired(config, db)
+	eh.alarm.reset(VoidExpired(eh.config, eh.db, eh.blobs))
+	VoidStaleUploads(eh.config, eh.db)
 
+	timer := time.NewTimer(eh.alarm.wait())
 	ticker := time.NewTicker(interval)
 	quit := make(chan interface{})
 	go func() {
 		for {
 			select {
+			case <-timer.C:
+				if err := eh.FlushAccess(); err != nil {
+					log.Error().Err(err).Msg("Could not write down the last downloads")
+				}
+				eh.alarm.reset(VoidExpired(eh.config, eh.db, eh.blobs))
+				timer.Reset(eh.alarm.wait())
+			case <-eh.alarm.wake:
+				timer.Reset(eh.alarm.wait())
 			case <-ticker.C:
-				VoidExpired(config, db)
+				if err := eh.FlushAccess(); err != nil {
+					log.Error().Err(err).Msg("Could not write down the last downloads")
+				}
+				VoidStaleUploads(eh.config, eh.db)
+				eh.makeSpace()
 			case <-quit:
 				ticker.Stop()
+				timer.Stop()
 				return
 			}
 		}
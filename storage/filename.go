@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	COLLISION_REJECT    = "reject"
+	COLLISION_OVERWRITE = "overwrite"
+	COLLISION_SUFFIX    = "suffix"
+
+	MAX_FILENAME_LENGTH = 200 // in bytes, leaving room for a suffix
+	MAX_SUFFIX          = 1000
+)
+
+// SanitizeFilename turns an uploaded filename into something that is safe to use both as
+// an entry ID in a URL and as a filename in the pile directory. Any directory part is
+// dropped, and whatever isn't a letter, a digit, '.', '-' or '_' becomes '_'.
+func SanitizeFilename(filename string) (string, error) {
+	base := filename
+	if i := strings.LastIndexAny(base, `/\`); i >= 0 {
+		base = base[i+1:]
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+			return r
+		case r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, base)
+	// No hidden files, no "." or "..", and nothing that looks like our own temporary files.
+	sanitized = strings.TrimLeft(sanitized, ".")
+
+	if len(sanitized) > MAX_FILENAME_LENGTH {
+		ext := path.Ext(sanitized)
+		if len(ext) > MAX_FILENAME_LENGTH/2 {
+			ext = ""
+		}
+		stem := sanitized[:MAX_FILENAME_LENGTH-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		sanitized = stem + ext
+	}
+
+	if sanitized == "" || strings.Trim(sanitized, "_") == "" {
+		return "", ErrUnacceptableFilename{Filename: filename}
+	}
+	return sanitized, nil
+}
+
+// pickFilenameEntry decides what entry ID an upload named after its file ends up with,
+// according to the collision policy of the pile.
+func pickFilenameEntry(bucket *bbolt.Bucket, pile string, name string, policy string) (string, error) {
+	if bucket.Get([]byte(name)) == nil {
+		return name, nil
+	}
+	switch policy {
+	case COLLISION_OVERWRITE:
+		return name, nil
+	case COLLISION_SUFFIX:
+		ext := path.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		for i := 1; i <= MAX_SUFFIX; i++ {
+			candidate := fmt.Sprintf("%s-%d%s", stem, i, ext)
+			if bucket.Get([]byte(candidate)) == nil {
+				return candidate, nil
+			}
+		}
+		return "", ErrEntryExists{Pile: pile, Entry: name}
+	default:
+		return "", ErrEntryExists{Pile: pile, Entry: name}
+	}
+}
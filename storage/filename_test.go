@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DemmyDemon/boltpile/storage"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	cases := map[string]string{
+		"report.pdf":              "report.pdf",
+		"../../etc/passwd":        "passwd",
+		`C:\Users\me\report.pdf`:  "report.pdf",
+		"..":                      "",
+		".hidden":                 "hidden",
+		".upload-1234":            "upload-1234",
+		"my report (final).pdf":   "my_report__final_.pdf",
+		"blåbærsyltetøy.txt":      "blåbærsyltetøy.txt",
+		"dir/":                    "",
+		"???":                     "",
+		"null\x00byte.txt":        "null_byte.txt",
+		"percent%2F..%2Fslash.js": "percent_2F.._2Fslash.js",
+	}
+	for input, expected := range cases {
+		sanitized, err := storage.SanitizeFilename(input)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", input, sanitized)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", input, err)
+			continue
+		}
+		if sanitized != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, sanitized)
+		}
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	sanitized, err := storage.SanitizeFilename(strings.Repeat("ø", 300) + ".tar")
+	if err != nil {
+		t.Errorf("sanitizing: %s", err)
+		return
+	}
+	if len(sanitized) > storage.MAX_FILENAME_LENGTH {
+		t.Errorf("%d bytes is longer than %d", len(sanitized), storage.MAX_FILENAME_LENGTH)
+	}
+	if !strings.HasSuffix(sanitized, ".tar") {
+		t.Errorf("%q lost the extension", sanitized)
+	}
+}
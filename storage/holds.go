@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// An entry on hold stays put until it's released. It doesn't expire, can't be
+// deleted, replaced or evicted, and its content survives even the last download.
+// Holding or releasing an entry twice is fine.
+
+// refuseHeld is ErrEntryHeld if there's an entry on hold by that name, which new
+// content isn't going to replace.
+func refuseHeld(tx *bbolt.Tx, pile string, entry string) error {
+	if entryMeta, err := getEntryMeta(tx, pile, entry); err == nil && entryMeta.IsHeld() {
+		return ErrEntryHeld{Pile: pile, Entry: entry}
+	}
+	return nil
+}
+
+func (eh BoltDatabase) HoldEntry(pile string, entry string) error {
+	pileConfig, err := eh.config.Pile(pile)
+	if err != nil {
+		return err
+	}
+	return eh.db.Update(func(tx *bbolt.Tx) error {
+		entryMeta, err := getEntryMeta(tx, pile, entry)
+		if err != nil {
+			return gone(tx, pile, entry, err)
+		}
+		if entryMeta.IsHeld() {
+			return nil
+		}
+		if err := unindexExpiry(tx, pileConfig, pile, entry, entryMeta); err != nil {
+			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		log.Info().Str("operation", "hold").Str("pile", pile).Str("entry", entry).Msg("Held!")
+		return putEntryMeta(tx, pile, entry, entryMeta.WithHold(time.Now().UTC()))
+	})
+}
+
+// ReleaseEntry takes an entry off hold. Whatever would have happened to it in the
+// meantime happens now: it might be downloaded out, or long expired.
+func (eh BoltDatabase) ReleaseEntry(pile string, entry string) error {
+	pileConfig, err := eh.config.Pile(pile)
+	if err != nil {
+		return err
+	}
+	return eh.db.Update(func(tx *bbolt.Tx) error {
+		entryMeta, err := getEntryMeta(tx, pile, entry)
+		if err != nil {
+			return gone(tx, pile, entry, err)
+		}
+		if !entryMeta.IsHeld() {
+			return nil
+		}
+		entryMeta = entryMeta.WithHold(time.Time{})
+		log.Info().Str("operation", "release").Str("pile", pile).Str("entry", entry).Msg("Released!")
+
+		if entryMeta.IsExhausted() {
+			prune, err := bury(tx, eh.config, pile, entry, entryMeta, TOMBSTONE_DOWNLOADED, time.Now())
+			if err != nil {
+				return ErrFailedDeletingEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+			}
+			eh.alarm.consider(prune)
+			if err := releaseBlob(tx, eh.blobs, blobKey(pile, entry, entryMeta)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+			}
+			return nil
+		}
+		if err := putEntryMeta(tx, pile, entry, entryMeta); err != nil {
+			return err
+		}
+		expires, err := indexExpiry(tx, pileConfig, pile, entry, entryMeta)
+		if err != nil {
+			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		eh.alarm.consider(expires)
+		return nil
+	})
+}
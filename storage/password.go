@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Entry passwords are kept as PBKDF2-HMAC-SHA256 hashes, stored as the iteration
+// count, the salt and the derived key, so the count can go up without breaking
+// the hashes that are already out there.
+const (
+	PASSWORD_ITERATIONS = 600_000
+	passwordSaltSize    = 16
+	passwordKeySize     = 32
+)
+
+func hashPassword(password string) ([]byte, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	hash := binary.LittleEndian.AppendUint32(nil, PASSWORD_ITERATIONS)
+	hash = append(hash, salt...)
+	return append(hash, pbkdf2.Key([]byte(password), salt, PASSWORD_ITERATIONS, passwordKeySize, sha256.New)...), nil
+}
+
+func checkPassword(hash []byte, password string) bool {
+	if len(hash) != 4+passwordSaltSize+passwordKeySize {
+		return false
+	}
+	iterations := int(binary.LittleEndian.Uint32(hash))
+	salt := hash[4 : 4+passwordSaltSize]
+	derived := pbkdf2.Key([]byte(password), salt, iterations, passwordKeySize, sha256.New)
+	return subtle.ConstantTimeCompare(derived, hash[4+passwordSaltSize:]) == 1
+}
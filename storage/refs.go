@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"io/fs"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// Content is stored once, under its SHA-256, no matter how many entries in how
+// many piles have it. The refs bucket counts the entries using each blob, and
+// the blob goes away with the last of them.
+
+// contentKey spreads the blobs over 256 directories, to keep any one of them from
+// growing huge. Compressed content gets the codec tacked on, as it's not the same
+// blob. Encrypted content gets the key and salt, which makes every one unique, as
+// there's no sharing content sealed with a key of its own.
+func contentKey(meta EntryMeta) string {
+	sum := hex.EncodeToString(meta.Digest())
+	key := "content/" + sum[:2] + "/" + sum
+	if meta.Codec() != "" {
+		key += "." + meta.Codec()
+	}
+	if meta.KeyID() != "" {
+		key += "." + meta.KeyID() + "-" + hex.EncodeToString(meta.Nonce())
+	}
+	return key
+}
+
+func blobRefs(tx *bbolt.Tx, key string) uint64 {
+	value := tx.Bucket(refsBucket).Get([]byte(key))
+	if len(value) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(value)
+}
+
+func setBlobRefs(tx *bbolt.Tx, key string, refs uint64) error {
+	if refs == 0 {
+		return tx.Bucket(refsBucket).Delete([]byte(key))
+	}
+	return tx.Bucket(refsBucket).Put([]byte(key), binary.LittleEndian.AppendUint64(nil, refs))
+}
+
+// blobLocks keeps a blob from being removed by one request while another is
+// putting the same content in place. The locks are shared by hash, as only the
+// network round trips to the BlobStore are done while holding one.
+var blobLocks [64]sync.Mutex
+
+func lockBlob(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	lock := &blobLocks[h.Sum32()%uint32(len(blobLocks))]
+	lock.Lock()
+	return lock
+}
+
+// stageBlob counts one more reference to freshly written content, and puts it under
+// its key, unless an identical blob is already there. It's done ahead of the
+// transaction that stores the entry, as committing a blob can mean a trip over the
+// network, and all other writes would have to wait for it. If that transaction
+// fails, releaseBlob takes the reference back.
+func stageBlob(db *bbolt.DB, writer BlobWriter, key string) error {
+	defer lockBlob(key).Unlock()
+	refs := uint64(0)
+	err := db.Update(func(tx *bbolt.Tx) error {
+		refs = blobRefs(tx, key)
+		return setBlobRefs(tx, key, refs+1)
+	})
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		return writer.Abort()
+	}
+	if err := writer.Commit(key); err != nil {
+		// Nobody else got to count on it, as they'd be waiting for the lock.
+		if err := db.Update(func(tx *bbolt.Tx) error {
+			return setBlobRefs(tx, key, blobRefs(tx, key)-1)
+		}); err != nil {
+			log.Error().Err(err).Str("blob", key).Msg("Could not take back the reference to a blob that failed to commit")
+		}
+		return err
+	}
+	return nil
+}
+
+// releaseBlob drops a reference to a blob, and removes it if that was the last one.
+// Blobs that were never counted, like those of entries from before deduplication,
+// are removed too. The removal waits until the transaction has committed, and
+// doesn't happen at all if it didn't.
+func releaseBlob(tx *bbolt.Tx, blobs BlobStore, key string) error {
+	refs := blobRefs(tx, key)
+	if refs > 1 {
+		return setBlobRefs(tx, key, refs-1)
+	}
+	if err := setBlobRefs(tx, key, 0); err != nil {
+		return err
+	}
+	db := tx.DB()
+	tx.OnCommit(func() {
+		removeBlob(db, blobs, key)
+	})
+	return nil
+}
+
+// removeBlob removes a blob nothing refers to, unless something came to refer to it
+// again since it was released.
+func removeBlob(db *bbolt.DB, blobs BlobStore, key string) {
+	defer lockBlob(key).Unlock()
+	refs := uint64(0)
+	err := db.View(func(tx *bbolt.Tx) error {
+		refs = blobRefs(tx, key)
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Str("blob", key).Msg("Could not tell if a released blob is still in use")
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	if err := blobs.Remove(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warn().Err(err).Str("blob", key).Msg("Could not remove a released blob")
+	}
+}
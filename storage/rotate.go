@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// RotateKeys re-encrypts the entries of a pile that aren't sealed with its current
+// key, including any from before the pile was encrypted at all. Each entry gets a
+// transaction of its own, so the pile can stay in use while this goes on.
+func (eh BoltDatabase) RotateKeys(pile string) (int, error) {
+	kr := eh.keyrings[pile]
+	if kr == nil {
+		return 0, fmt.Errorf("pile %s is not encrypted", pile)
+	}
+	entries, err := eh.GetPileEntries(pile)
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for entry, meta := range entries {
+		if meta.KeyID() == kr.current.id || meta.IsExhausted() {
+			continue
+		}
+		if meta.Digest() == nil {
+			log.Warn().Str("operation", "rotate").Str("pile", pile).Str("entry", entry).Msg("Entry is too old to be re-encrypted")
+			continue
+		}
+		if err := eh.rotateEntry(pile, entry, meta, kr.current); err != nil {
+			return rotated, err
+		}
+		log.Info().Str("operation", "rotate").Str("pile", pile).Str("entry", entry).Str("from", meta.KeyID()).Str("to", kr.current.id).Msg("Re-encrypted")
+		rotated++
+	}
+	return rotated, nil
+}
+
+// rotateEntry seals the content as it is stored, still compressed if it was, with the key.
+func (eh BoltDatabase) rotateEntry(pile string, entry string, meta EntryMeta, key encryptionKey) error {
+	previous := blobKey(pile, entry, meta)
+	blob, err := eh.blobs.Open(previous)
+	if err != nil {
+		return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	defer blob.Close()
+	var stored io.Reader = blob
+	if meta.KeyID() != "" {
+		if stored, err = eh.openSealed(pile, entry, meta, blob); err != nil {
+			return err
+		}
+	}
+
+	writer, err := eh.blobs.Create()
+	if err != nil {
+		return ErrFailedCreatingEntryFile{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	defer writer.Abort() // Does nothing once committed.
+	sealer, err := newSealingWriter(writer, key)
+	if err != nil {
+		return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	if _, err := io.Copy(sealer, stored); err != nil {
+		return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+	if err := sealer.Close(); err != nil {
+		return ErrDuringFileOperation{Pile: pile, Entry: entry, UpstreamError: err}
+	}
+
+	rotated := meta.WithEncryption(key.id, sealer.salt)
+	return eh.storeEntry(pile, entry, rotated, writer, func(tx *bbolt.Tx) error {
+		// Replaced or deleted while we were at it means there's nothing left to rotate.
+		value := tx.Bucket([]byte(pile)).Get([]byte(entry))
+		if value == nil {
+			return releaseBlob(tx, eh.blobs, contentKey(rotated))
+		}
+		current, err := EntryMetaFromBytes(value)
+		if err != nil {
+			return ErrUnparsableMeta{Raw: value, ParseError: err}
+		}
+		if blobKey(pile, entry, current) != previous {
+			return releaseBlob(tx, eh.blobs, contentKey(rotated))
+		}
+		return eh.putEntry(tx, pile, entry, current.WithEncryption(key.id, sealer.salt))
+	})
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"os"
+)
+
+// stager is a BlobStore that writes its blobs to local files before they're
+// committed. Spooled uploads go in the same place.
+type stager interface {
+	stagingDirectory() string
+}
+
+func (fss FilesystemStore) stagingDirectory() string {
+	return fss.root
+}
+
+func (s3 S3Store) stagingDirectory() string {
+	return s3.staging
+}
+
+// SpoolEntry makes somewhere to keep an upload until it can be stored. It's where
+// the blob store stages its writes, so it's held to the same disk watermarks, and
+// anything left behind by a crash is swept up at startup like any other upload.
+func (eh BoltDatabase) SpoolEntry(pile string) (Spool, error) {
+	if _, err := eh.config.Pile(pile); err != nil {
+		return nil, err
+	}
+	if err := eh.checkDisk(pile); err != nil {
+		return nil, err
+	}
+	directory := "" // The memory store has nowhere better, so the system default it is.
+	if staging, ok := eh.blobs.(stager); ok {
+		directory = staging.stagingDirectory()
+		if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+			return nil, ErrFailedCreatingEntryFile{Pile: pile, UpstreamError: err}
+		}
+	}
+	file, err := os.CreateTemp(directory, TEMP_PREFIX+"*")
+	if err != nil {
+		return nil, ErrFailedCreatingEntryFile{Pile: pile, UpstreamError: err}
+	}
+	return spooledFile{file}, nil
+}
+
+type spooledFile struct {
+	*os.File
+}
+
+// Close removes the file, as it's only ever needed until the upload is stored.
+func (f spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/rs/zerolog/log"
 	"go.etcd.io/bbolt"
@@ -31,14 +32,51 @@ CANDIDATES:
 	return false
 }
 
-func Startup(config Config, db *bbolt.DB) error {
+// createInternalBuckets makes sure there's somewhere to keep the indexes and such,
+// for anything that gets to the database before Startup does.
+func createInternalBuckets(tx *bbolt.Tx) error {
+	for _, bucketName := range internalBuckets {
+		if _, err := tx.CreateBucketIfNotExists(bucketName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropPile gets rid of a pile that is no longer configured, letting go of the blobs
+// its entries were using.
+func dropPile(tx *bbolt.Tx, blobs BlobStore, name []byte, bucket *bbolt.Bucket) error {
+	err := bucket.ForEach(func(k, v []byte) error {
+		// Unparsable entries can only be from before there were blobs of their own.
+		entryMeta, _ := EntryMetaFromBytes(v)
+		return releaseBlob(tx, blobs, blobKey(string(name), string(k), entryMeta))
+	})
+	if err != nil {
+		return err
+	}
+	return tx.DeleteBucket(name)
+}
+
+func Startup(config Config, db *bbolt.DB, blobs BlobStore) error {
 	return db.Update(func(tx *bbolt.Tx) error {
+		if err := config.Disk.Validate(); err != nil {
+			return fmt.Errorf("disk: %w", err)
+		}
 		bucketNames := config.BucketNames()
 		if len(bucketNames) == 0 {
 			return errors.New("no piles configured")
 		}
+		if err := createInternalBuckets(tx); err != nil {
+			return err
+		}
 		for _, bucketName := range bucketNames {
+			if IsInternalBucket(bucketName) {
+				return fmt.Errorf("pile name %q is reserved", bucketName)
+			}
 			cfg := config.Piles[string(bucketName)]
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("pile %s: %w", bucketName, err)
+			}
 			newBucket, err := tx.CreateBucketIfNotExists(bucketName)
 			if err != nil {
 				return err
@@ -50,25 +88,91 @@ func Startup(config Config, db *bbolt.DB) error {
 				Bool("GET key", cfg.GETKey != "").
 				Bool("POST key", cfg.POSTKey != "").
 				Bool("list key", cfg.ListKey != "").
+				Bool("PUT key", cfg.PUTKey != "").
+				Bool("DELETE key", cfg.DELETEKey != "").
 				Str("lifetime", cfg.Lifetime.String()).
+				Str("max lifetime", cfg.MaxLifetime.String()).
+				Bool("sliding expiry", cfg.SlidingExpiry).
+				Int("max entries", cfg.MaxEntries).
+				Int64("max total bytes", cfg.MaxTotalBytes).
+				Str("when full", cfg.WhenFull).
+				Str("trash grace", cfg.TrashGrace.String()).
 				Str("CORS origin", cfg.Origin).
+				Bool("use filename", cfg.UseFilename).
+				Str("compression", cfg.Compression).
+				Bool("encrypted", cfg.IsEncrypted()).
 				Msg("Ready!")
 			log.Debug().
 				Str("GET key", cfg.GETKey).
 				Str("POST key", cfg.POSTKey).
 				Str("list key", cfg.ListKey).
+				Str("PUT key", cfg.PUTKey).
+				Str("DELETE key", cfg.DELETEKey).
 				Msg("Keys set!")
 		}
-		return tx.ForEach(func(name []byte, bucket *bbolt.Bucket) error {
-			if !IsConfiguredBucket(bucketNames, name) {
+		err := tx.ForEach(func(name []byte, bucket *bbolt.Bucket) error {
+			if !IsInternalBucket(name) && !IsConfiguredBucket(bucketNames, name) {
 				size := bucket.Stats().KeyN
 				log.Warn().Str("pile", string(name)).Int("keys", size).Msg("Not in configuration, so ***REMOVED***")
-				err := tx.DeleteBucket(name)
-				if err != nil {
+				if err := dropPile(tx, blobs, name, bucket); err != nil {
 					return err
 				}
 			}
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+		return rebuildIndexes(tx, config, blobs)
 	})
 }
+
+// rebuildIndexes starts the expiry index, the ages and the usage of each pile over,
+// from the entries themselves. The config they depend on might have changed.
+// Entries stored before their size was recorded get it from their blob on the way.
+func rebuildIndexes(tx *bbolt.Tx, config Config, blobs BlobStore) error {
+	for _, name := range [][]byte{expiryBucket, usageBucket, agesBucket} {
+		if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+			return err
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	for pile, pileConfig := range config.Piles {
+		sized := map[string]EntryMeta{}
+		err := tx.Bucket([]byte(pile)).ForEach(func(k, v []byte) error {
+			entryMeta, err := EntryMetaFromBytes(v)
+			if err != nil {
+				log.Warn().Err(err).Str("pile", pile).Str("entry", string(k)).Msg("Unparsable entry will never expire, nor count towards capacity")
+				return nil
+			}
+			if !entryMeta.HasContentInfo() && entryMeta.Size() == 0 {
+				size, err := blobs.Size(blobKey(pile, string(k), entryMeta))
+				if err != nil {
+					log.Warn().Err(err).Str("pile", pile).Str("entry", string(k)).Msg("Entry of unknown size will not count towards capacity")
+				} else if size > 0 {
+					entryMeta = entryMeta.withSize(size)
+					sized[string(k)] = entryMeta
+				}
+			}
+			if _, err := indexExpiry(tx, pileConfig, pile, string(k), entryMeta); err != nil {
+				return err
+			}
+			return countEntry(tx, pile, string(k), entryMeta)
+		})
+		if err != nil {
+			return fmt.Errorf("indexing pile %s: %w", pile, err)
+		}
+		// The bucket is not to be written while it's walked.
+		for entry, entryMeta := range sized {
+			if err := putEntryMeta(tx, pile, entry, entryMeta); err != nil {
+				return err
+			}
+		}
+	}
+	if err := indexTombstones(tx, config); err != nil {
+		return err
+	}
+	return indexTrash(tx, config)
+}
@@ -7,24 +7,102 @@ import (
 
 const (
 	TIME_FORMAT = time.RFC3339
+	TEMP_PREFIX = ".upload-"
 )
 
+// Buckets for our own bookkeeping live next to the piles. Their names start with
+// a zero byte, so they can't be mistaken for a pile, and startup leaves them be.
+var (
+	uploadsBucket = []byte("\x00uploads")
+	refsBucket    = []byte("\x00refs")
+	accessBucket  = []byte("\x00access")
+	expiryBucket  = []byte("\x00expiry")
+
+	tombstonesBucket = []byte("\x00tombstones")
+	usageBucket      = []byte("\x00usage")
+	agesBucket       = []byte("\x00ages")
+	trashBucket      = []byte("\x00trash")
+
+	internalBuckets = [][]byte{uploadsBucket, refsBucket, accessBucket, expiryBucket, tombstonesBucket, usageBucket, agesBucket, trashBucket}
+)
+
+func IsInternalBucket(name []byte) bool {
+	return len(name) > 0 && name[0] == 0
+}
+
 type CreateWithFunc func(id string, destination io.Writer) error
-type GetWithFunc func(metaData EntryMeta, MIMEType string, file io.Reader) error
+type GetWithFunc func(metaData EntryMeta, MIMEType string, file io.ReadSeeker) error
+type StatWithFunc func(metaData EntryMeta, MIMEType string, size int64) error
+
+// UploadInfo is what we're told about an upload, as opposed to what we find out while storing it.
+type UploadInfo struct {
+	Filename    string
+	Peer        string
+	ContentType string        // Detected from the content when left empty.
+	Password    string        // Needed to get the entry, unless left empty.
+	Downloads   uint64        // How many times the entry can be downloaded. Zero is no limit.
+	Lifetime    time.Duration // Instead of the pile lifetime, unless zero.
+	Length      int64         // How big the upload says it is, if it says. Zero is not knowing.
 
+	passwordHash []byte // Instead of Password, for uploads that were hashed ahead of time.
+}
+
+type EntryMetaGetter interface {
+	GetEntryMeta(pile string, entry string) (EntryMeta, error)
+}
 type EntryGetter interface {
+	EntryMetaGetter
 	GetEntry(pile string, entry string, read GetWithFunc) (err error)
 }
+type EntryStatter interface {
+	EntryMetaGetter
+	StatEntry(pile string, entry string, stat StatWithFunc) (err error)
+}
+
+// Spool is an upload kept aside until it can be stored. Closing it removes it.
+type Spool interface {
+	io.ReadWriteSeeker
+	io.Closer
+}
+type EntrySpooler interface {
+	SpoolEntry(pile string) (Spool, error)
+}
 type EntryCreator interface {
-	CreateEntry(pile string, entry string, creator CreateWithFunc) (entryID string, err error)
+	EntrySpooler
+	CreateEntry(pile string, upload UploadInfo, creator CreateWithFunc) (entryID string, err error)
+}
+type EntryReplacer interface {
+	EntrySpooler
+	ReplaceEntry(pile string, entry string, upload UploadInfo, creator CreateWithFunc) (err error)
+}
+type EntryDeleter interface {
+	DeleteEntry(pile string, entry string) (err error)
 }
 type EntryHandler interface {
 	EntryGetter
+	EntryStatter
 	EntryCreator
+	EntryReplacer
+	EntryDeleter
+	UploadHandler
 }
 type Starter interface {
 	Startup(Config) error
 }
+type UploadHandler interface {
+	CreateUpload(pile string, upload UploadInfo, length int64) (Upload, error)
+	GetUpload(pile string, id string) (Upload, error)
+	WriteUpload(pile string, id string, offset int64, data io.Reader) (Upload, error)
+	DeleteUpload(pile string, id string) error
+}
 type PileGetter interface {
 	GetPileEntries(pile string) (map[string]EntryMeta, error)
 }
+type EntryHolder interface {
+	HoldEntry(pile string, entry string) error
+	ReleaseEntry(pile string, entry string) error
+}
+type TrashHandler interface {
+	GetTrash(pile string) (map[string]TrashedEntry, error)
+	RestoreEntry(pile string, entry string) error
+}
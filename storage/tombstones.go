@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// When an entry goes away, a tombstone is left in its place for a while, so
+// anyone coming for it can be told what happened, rather than just "not found".
+// Tombstones are in the expiry index too, under when they are to be pruned.
+const (
+	TOMBSTONE_EXPIRED    = "expired"
+	TOMBSTONE_DELETED    = "deleted"
+	TOMBSTONE_DOWNLOADED = "downloaded"
+
+	TOMBSTONE_RETENTION_DEFAULT = 7 * 24 * time.Hour
+)
+
+type tombstone struct {
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+func getTombstone(tx *bbolt.Tx, pile string, entry string) (tombstone, bool) {
+	value := tx.Bucket(tombstonesBucket).Get([]byte(accessKey(pile, entry)))
+	if value == nil {
+		return tombstone{}, false
+	}
+	ts := tombstone{}
+	if err := json.Unmarshal(value, &ts); err != nil {
+		return tombstone{}, false
+	}
+	return ts, true
+}
+
+// gone is the error for an entry that isn't there, depending on if it ever was.
+func gone(tx *bbolt.Tx, pile string, entry string, err error) error {
+	if _, missing := err.(ErrNoSuchEntry); !missing {
+		return err
+	}
+	if ts, found := getTombstone(tx, pile, entry); found {
+		return ErrEntryGone{Pile: pile, Entry: entry, Reason: ts.Reason, Time: ts.Time}
+	}
+	return err
+}
+
+// bury takes out an entry and leaves a tombstone. Its content is up to the caller.
+// It returns when the tombstone is to be pruned.
+func bury(tx *bbolt.Tx, config Config, pile string, entry string, entryMeta EntryMeta, reason string, now time.Time) (time.Time, error) {
+	if err := unindexExpiry(tx, config.Piles[pile], pile, entry, entryMeta); err != nil {
+		return time.Time{}, err
+	}
+	if err := tx.Bucket([]byte(pile)).Delete([]byte(entry)); err != nil {
+		return time.Time{}, err
+	}
+	if err := forgetAccess(tx, pile, entry); err != nil {
+		return time.Time{}, err
+	}
+	if err := uncountEntry(tx, pile, entry, entryMeta); err != nil {
+		return time.Time{}, err
+	}
+	value, err := json.Marshal(tombstone{Reason: reason, Time: now.UTC()})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := tx.Bucket(tombstonesBucket).Put([]byte(accessKey(pile, entry)), value); err != nil {
+		return time.Time{}, err
+	}
+	prune := now.Add(config.TombstoneRetention())
+	return prune, tx.Bucket(expiryBucket).Put(expiryKey(prune, pile, entry), nil)
+}
+
+// pruneTombstone removes the tombstone of an entry, if it's been around long enough.
+func pruneTombstone(tx *bbolt.Tx, config Config, pile string, entry string, now time.Time) (bool, error) {
+	ts, found := getTombstone(tx, pile, entry)
+	if !found || ts.Time.Add(config.TombstoneRetention()).After(now) {
+		return false, nil
+	}
+	return true, tx.Bucket(tombstonesBucket).Delete([]byte(accessKey(pile, entry)))
+}
+
+func indexTombstones(tx *bbolt.Tx, config Config) error {
+	unparsable := [][]byte{}
+	err := tx.Bucket(tombstonesBucket).ForEach(func(k, v []byte) error {
+		ts := tombstone{}
+		if err := json.Unmarshal(v, &ts); err != nil {
+			unparsable = append(unparsable, k)
+			return nil
+		}
+		pile, entry, _ := strings.Cut(string(k), "/")
+		return tx.Bucket(expiryBucket).Put(expiryKey(ts.Time.Add(config.TombstoneRetention()), pile, entry), nil)
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range unparsable {
+		if err := tx.Bucket(tombstonesBucket).Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// In piles with a trash grace period, entries that expire or are deleted keep their
+// content around in the trash for that long, in case they're missed. The trash
+// doesn't count towards max_entries or max_total_bytes, so evicted entries, and
+// those culled for disk space, skip it. Like tombstones, the trash is in the
+// expiry index, under when it's to be purged.
+
+// TrashedEntry is an entry that's gone, but can still be restored.
+type TrashedEntry struct {
+	Meta   EntryMeta
+	Reason string
+	Time   time.Time
+}
+
+// Purges is when the trashed entry is gone for good.
+func (te TrashedEntry) Purges(grace time.Duration) time.Time {
+	return te.Time.Add(grace)
+}
+
+type trashRecord struct {
+	Meta   []byte    `json:"meta"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+func getTrash(tx *bbolt.Tx, pile string, entry string) (TrashedEntry, bool) {
+	value := tx.Bucket(trashBucket).Get([]byte(accessKey(pile, entry)))
+	if value == nil {
+		return TrashedEntry{}, false
+	}
+	return parseTrash(value)
+}
+
+func parseTrash(value []byte) (TrashedEntry, bool) {
+	record := trashRecord{}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return TrashedEntry{}, false
+	}
+	entryMeta, err := EntryMetaFromBytes(record.Meta)
+	if err != nil {
+		return TrashedEntry{}, false
+	}
+	return TrashedEntry{Meta: entryMeta, Reason: record.Reason, Time: record.Time}, true
+}
+
+// discard puts the content of a buried entry in the trash, if the pile has one,
+// or lets go of it. It returns when the trash is to be purged, if it went there.
+func discard(tx *bbolt.Tx, config Config, blobs BlobStore, pile string, entry string, entryMeta EntryMeta, reason string, now time.Time) (time.Time, error) {
+	grace := config.Piles[pile].TrashGrace.Duration
+	if grace <= 0 {
+		return time.Time{}, releaseBlob(tx, blobs, blobKey(pile, entry, entryMeta))
+	}
+	// Something by the same name might have been trashed before. It's had its chance.
+	if _, err := purgeTrash(tx, config, blobs, pile, entry, time.Time{}); err != nil {
+		return time.Time{}, err
+	}
+	metaBytes, err := entryMeta.Bytes()
+	if err != nil {
+		return time.Time{}, err
+	}
+	value, err := json.Marshal(trashRecord{Meta: metaBytes, Reason: reason, Time: now.UTC()})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := tx.Bucket(trashBucket).Put([]byte(accessKey(pile, entry)), value); err != nil {
+		return time.Time{}, err
+	}
+	purge := now.Add(grace)
+	return purge, tx.Bucket(expiryBucket).Put(expiryKey(purge, pile, entry), nil)
+}
+
+// purgeTrash finally lets go of a trashed entry, if it's been there long enough.
+// The zero time means now, whatever the grace period.
+func purgeTrash(tx *bbolt.Tx, config Config, blobs BlobStore, pile string, entry string, now time.Time) (bool, error) {
+	trashed, found := getTrash(tx, pile, entry)
+	if !found {
+		return false, nil
+	}
+	if !now.IsZero() && trashed.Purges(config.Piles[pile].TrashGrace.Duration).After(now) {
+		return false, nil
+	}
+	if err := tx.Bucket(trashBucket).Delete([]byte(accessKey(pile, entry))); err != nil {
+		return false, err
+	}
+	if err := tx.Bucket(expiryBucket).Delete(expiryKey(trashed.Purges(config.Piles[pile].TrashGrace.Duration), pile, entry)); err != nil {
+		return false, err
+	}
+	log.Info().Str("operation", "purge").Str("pile", pile).Str("entry", entry).Msg("Purged!")
+	if err := releaseBlob(tx, blobs, blobKey(pile, entry, trashed.Meta)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("purge file %s: %w", entry, err)
+	}
+	return true, nil
+}
+
+func indexTrash(tx *bbolt.Tx, config Config) error {
+	unparsable := [][]byte{}
+	err := tx.Bucket(trashBucket).ForEach(func(k, v []byte) error {
+		trashed, ok := parseTrash(v)
+		if !ok {
+			unparsable = append(unparsable, k)
+			return nil
+		}
+		pile, entry, _ := strings.Cut(string(k), "/")
+		return tx.Bucket(expiryBucket).Put(expiryKey(trashed.Purges(config.Piles[pile].TrashGrace.Duration), pile, entry), nil)
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range unparsable {
+		log.Warn().Str("key", string(k)).Msg("Dropping unparsable entry from the trash")
+		if err := tx.Bucket(trashBucket).Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTrash is everything in the trash of a pile, by entry.
+func (eh BoltDatabase) GetTrash(pile string) (map[string]TrashedEntry, error) {
+	entries := make(map[string]TrashedEntry)
+	err := eh.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(pile)) == nil {
+			return ErrNoSuchPile{pile}
+		}
+		prefix := []byte(pile + "/")
+		cursor := tx.Bucket(trashBucket).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = cursor.Next() {
+			if trashed, ok := parseTrash(v); ok {
+				entries[string(k[len(prefix):])] = trashed
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// RestoreEntry takes an entry back out of the trash, as if it never left. If it
+// expired, it gets a whole new lifetime, or it would just expire again.
+func (eh BoltDatabase) RestoreEntry(pile string, entry string) error {
+	pileConfig, err := eh.config.Pile(pile)
+	if err != nil {
+		return err
+	}
+	return eh.db.Update(func(tx *bbolt.Tx) error {
+		trashed, found := getTrash(tx, pile, entry)
+		if !found {
+			return ErrNotInTrash{Pile: pile, Entry: entry}
+		}
+		if err := entryExists(tx, pile, entry); err == nil {
+			return ErrEntryExists{Pile: pile, Entry: entry}
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		entryMeta := trashed.Meta
+		if expires := entryMeta.Expires(pileConfig.Lifetime.Duration); !expires.IsZero() && !expires.After(now) {
+			entryMeta = entryMeta.WithExpiry(now.Add(expires.Sub(entryMeta.Time())))
+		}
+
+		if err := tx.Bucket(trashBucket).Delete([]byte(accessKey(pile, entry))); err != nil {
+			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		if err := tx.Bucket(expiryBucket).Delete(expiryKey(trashed.Purges(pileConfig.TrashGrace.Duration), pile, entry)); err != nil {
+			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		if err := tx.Bucket(tombstonesBucket).Delete([]byte(accessKey(pile, entry))); err != nil {
+			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		// Restoring is on purpose, so it doesn't have to fit in the pile capacity.
+		if err := putEntryMeta(tx, pile, entry, entryMeta); err != nil {
+			return err
+		}
+		expires, err := indexExpiry(tx, pileConfig, pile, entry, entryMeta)
+		if err != nil {
+			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		eh.alarm.consider(expires)
+		if err := countEntry(tx, pile, entry, entryMeta); err != nil {
+			return ErrFailedStoringEntryMetadata{Pile: pile, Entry: entry, UpstreamError: err}
+		}
+		log.Info().Str("operation", "restore").Str("pile", pile).Str("entry", entry).Str("reason", trashed.Reason).Msg("Restored!")
+		return nil
+	})
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	UPLOAD_MAX_AGE   = 24 * time.Hour
+	UPLOAD_DIRECTORY = "uploads"
+)
+
+// Upload is a resumable upload in progress. The data trickles into a file in the
+// upload directory, and once all of it has arrived it becomes a regular entry.
+// The password is hashed right away, so it's never kept around as it was given.
+type Upload struct {
+	ID           string        `json:"-"`
+	Pile         string        `json:"pile"`
+	Filename     string        `json:"filename"`
+	Peer         string        `json:"peer"`
+	Length       int64         `json:"length"`
+	Offset       int64         `json:"offset"`
+	Created      time.Time     `json:"created"`
+	Entry        string        `json:"entry,omitempty"`
+	Lifetime     time.Duration `json:"lifetime,omitempty"`
+	Downloads    uint64        `json:"downloads,omitempty"`
+	PasswordHash []byte        `json:"password_hash,omitempty"`
+}
+
+func (u Upload) IsComplete() bool {
+	return u.Entry != ""
+}
+
+// uploadPath is always on the local filesystem, whatever BlobStore is in use, as
+// the data has to be appended to piece by piece.
+func uploadPath(pile string, id string) string {
+	return path.Join(UPLOAD_DIRECTORY, pile+"-"+id)
+}
+
+// uploadLocks makes sure only one request at a time gets to write to an upload.
+type uploadLocks struct {
+	locks sync.Map
+}
+
+func (ul *uploadLocks) tryLock(id string) bool {
+	lock, _ := ul.locks.LoadOrStore(id, &sync.Mutex{})
+	return lock.(*sync.Mutex).TryLock()
+}
+
+func (ul *uploadLocks) unlock(id string) {
+	if lock, ok := ul.locks.Load(id); ok {
+		lock.(*sync.Mutex).Unlock()
+	}
+}
+
+func (ul *uploadLocks) forget(id string) {
+	ul.locks.Delete(id)
+}
+
+func getUpload(tx *bbolt.Tx, pile string, id string) (Upload, error) {
+	value := tx.Bucket(uploadsBucket).Get([]byte(id))
+	if value == nil {
+		return Upload{}, ErrNoSuchUpload{Pile: pile, Upload: id}
+	}
+	upload := Upload{}
+	if err := json.Unmarshal(value, &upload); err != nil {
+		return upload, ErrUnparsableMeta{Raw: value, ParseError: err}
+	}
+	if upload.Pile != pile {
+		return Upload{}, ErrNoSuchUpload{Pile: pile, Upload: id}
+	}
+	upload.ID = id
+	return upload, nil
+}
+
+func putUpload(tx *bbolt.Tx, upload Upload) error {
+	value, err := json.Marshal(upload)
+	if err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: upload.Pile, Entry: upload.ID, UpstreamError: err}
+	}
+	if err := tx.Bucket(uploadsBucket).Put([]byte(upload.ID), value); err != nil {
+		return ErrFailedStoringEntryMetadata{Pile: upload.Pile, Entry: upload.ID, UpstreamError: err}
+	}
+	return nil
+}
+
+func (eh BoltDatabase) CreateUpload(pile string, info UploadInfo, length int64) (Upload, error) {
+	pileConfig, err := eh.config.Pile(pile)
+	if err != nil {
+		return Upload{}, err
+	}
+	if err := eh.checkDisk(pile); err != nil {
+		return Upload{}, err
+	}
+	if info.Lifetime != 0 && !pileConfig.AllowsLifetime(info.Lifetime) {
+		return Upload{}, ErrUnacceptableLifetime{Pile: pile, Lifetime: info.Lifetime}
+	}
+	entry := ""
+	if pileConfig.UseFilename {
+		entry, _ = SanitizeFilename(info.Filename)
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return Upload{}, ErrFailedMakingId{err}
+	}
+	upload := Upload{
+		ID:        id.String(),
+		Pile:      pile,
+		Filename:  info.Filename,
+		Peer:      info.Peer,
+		Length:    length,
+		Created:   time.Now().UTC(),
+		Lifetime:  info.Lifetime,
+		Downloads: info.Downloads,
+	}
+	if info.Password != "" {
+		upload.PasswordHash, err = hashPassword(info.Password)
+		if err != nil {
+			return Upload{}, ErrFailedStoringEntryMetadata{Pile: pile, Entry: upload.ID, UpstreamError: err}
+		}
+	}
+
+	err = eh.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(pile)) == nil {
+			return ErrNoSuchPile{pile}
+		}
+		// The whole length is known up front, so there's no sense taking it if it won't fit.
+		if err := checkRoom(tx, pileConfig, pile, entry, length); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(UPLOAD_DIRECTORY, os.ModePerm); err != nil {
+			return ErrFailedCreatingPileDirectory{Pile: pile, UpstreamError: err}
+		}
+		file, err := os.OpenFile(uploadPath(pile, upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return ErrFailedCreatingEntryFile{Pile: pile, Entry: upload.ID, UpstreamError: err}
+		}
+		if err := file.Close(); err != nil {
+			return ErrFailedCreatingEntryFile{Pile: pile, Entry: upload.ID, UpstreamError: err}
+		}
+		return putUpload(tx, upload)
+	})
+	if err != nil {
+		return upload, err
+	}
+	if length == 0 {
+		// Nothing more is coming, so it's done already.
+		return eh.WriteUpload(pile, upload.ID, 0, nil)
+	}
+	return upload, nil
+}
+
+func (eh BoltDatabase) GetUpload(pile string, id string) (Upload, error) {
+	upload := Upload{}
+	err := eh.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		upload, err = getUpload(tx, pile, id)
+		return err
+	})
+	return upload, err
+}
+
+// WriteUpload appends data to the upload, which has to be at the given offset.
+// Whatever made it to disk counts, even if the data stream breaks off half-way.
+// When the last byte is in, the upload is turned into an entry.
+func (eh BoltDatabase) WriteUpload(pile string, id string, offset int64, data io.Reader) (Upload, error) {
+	if !eh.uploads.tryLock(id) {
+		return Upload{}, ErrUploadLocked{Pile: pile, Upload: id}
+	}
+	upload := Upload{}
+	defer func() {
+		eh.uploads.unlock(id)
+		if upload.IsComplete() {
+			eh.uploads.forget(id)
+		}
+	}()
+
+	upload, err := eh.GetUpload(pile, id)
+	if err != nil {
+		return upload, err
+	}
+	if upload.IsComplete() || offset != upload.Offset {
+		return upload, ErrUploadOffsetMismatch{Pile: pile, Upload: id, Expected: upload.Offset, Got: offset}
+	}
+
+	if upload.Offset < upload.Length && data != nil {
+		written, writeErr := appendToUpload(upload, data)
+		if written > 0 {
+			upload.Offset += written
+			err := eh.db.Update(func(tx *bbolt.Tx) error {
+				return putUpload(tx, upload)
+			})
+			if err != nil {
+				return upload, err
+			}
+		}
+		if writeErr != nil {
+			return upload, writeErr
+		}
+	}
+
+	if upload.Offset < upload.Length {
+		return upload, nil
+	}
+	return eh.finishUpload(upload)
+}
+
+func appendToUpload(upload Upload, data io.Reader) (int64, error) {
+	file, err := os.OpenFile(uploadPath(upload.Pile, upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, ErrDuringFileOperation{Pile: upload.Pile, Entry: upload.ID, UpstreamError: err}
+	}
+	defer file.Close()
+	if _, err := file.Seek(upload.Offset, io.SeekStart); err != nil {
+		return 0, ErrDuringFileOperation{Pile: upload.Pile, Entry: upload.ID, UpstreamError: err}
+	}
+
+	remaining := upload.Length - upload.Offset
+	written, copyErr := io.Copy(file, io.LimitReader(data, remaining))
+	if err := file.Sync(); err != nil {
+		return 0, ErrDuringFileOperation{Pile: upload.Pile, Entry: upload.ID, UpstreamError: err}
+	}
+	if copyErr != nil {
+		return written, ErrDuringFileOperation{Pile: upload.Pile, Entry: upload.ID, UpstreamError: copyErr}
+	}
+	if written == remaining {
+		if n, _ := data.Read(make([]byte, 1)); n > 0 {
+			return written, ErrUploadTooLong{Pile: upload.Pile, Upload: upload.ID, Length: upload.Length}
+		}
+	}
+	return written, nil
+}
+
+// finishUpload hands the data over to CreateEntry. If that fails, the upload stays
+// put with all its bytes, and an empty write at the final offset will try again.
+func (eh BoltDatabase) finishUpload(upload Upload) (Upload, error) {
+	info := UploadInfo{
+		Filename:     upload.Filename,
+		Peer:         upload.Peer,
+		Downloads:    upload.Downloads,
+		Lifetime:     upload.Lifetime,
+		Length:       upload.Length,
+		passwordHash: upload.PasswordHash,
+	}
+	entry, err := eh.CreateEntry(upload.Pile, info, func(id string, dst io.Writer) error {
+		file, err := os.Open(uploadPath(upload.Pile, upload.ID))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(dst, file)
+		return err
+	})
+	if err != nil {
+		return upload, err
+	}
+
+	upload.Entry = entry
+	err = eh.db.Update(func(tx *bbolt.Tx) error {
+		return putUpload(tx, upload)
+	})
+	if err != nil {
+		return upload, err
+	}
+	if err := os.Remove(uploadPath(upload.Pile, upload.ID)); err != nil {
+		log.Warn().Err(err).Str("operation", "upload").Str("pile", upload.Pile).Str("upload", upload.ID).Msg("Could not remove finished upload data")
+	}
+	return upload, nil
+}
+
+func (eh BoltDatabase) DeleteUpload(pile string, id string) error {
+	if !eh.uploads.tryLock(id) {
+		return ErrUploadLocked{Pile: pile, Upload: id}
+	}
+	defer eh.uploads.forget(id)
+	defer eh.uploads.unlock(id)
+
+	return eh.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := getUpload(tx, pile, id); err != nil {
+			return err
+		}
+		return removeUpload(tx, pile, id)
+	})
+}
+
+func removeUpload(tx *bbolt.Tx, pile string, id string) error {
+	if err := tx.Bucket(uploadsBucket).Delete([]byte(id)); err != nil {
+		return ErrFailedDeletingEntryMetadata{Pile: pile, Entry: id, UpstreamError: err}
+	}
+	if err := os.Remove(uploadPath(pile, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ErrDuringFileOperation{Pile: pile, Entry: id, UpstreamError: err}
+	}
+	return nil
+}
+
+// VoidStaleUploads gets rid of uploads that were abandoned, finished a good while
+// ago, or belong to a pile that is no longer configured.
+func VoidStaleUploads(config Config, db *bbolt.DB) {
+	now := time.Now()
+	err := db.Update(func(tx *bbolt.Tx) error {
+		stale := map[string]string{}
+		err := tx.Bucket(uploadsBucket).ForEach(func(k, v []byte) error {
+			upload := Upload{}
+			if err := json.Unmarshal(v, &upload); err != nil {
+				log.Warn().Err(err).Str("operation", "expire").Str("upload", string(k)).Msg("Unparsable upload state")
+				stale[string(k)] = upload.Pile
+				return nil
+			}
+			if _, configured := config.Piles[upload.Pile]; !configured || now.After(upload.Created.Add(UPLOAD_MAX_AGE)) {
+				stale[string(k)] = upload.Pile
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for id, pile := range stale {
+			log.Info().Str("operation", "expire").Str("pile", pile).Str("upload", id).Msg("Stale upload removed")
+			if err := removeUpload(tx, pile, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Error during VoidStaleUploads operation")
+	}
+}